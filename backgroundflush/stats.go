@@ -0,0 +1,65 @@
+package backgroundflush
+
+import (
+	"time"
+)
+
+const (
+	NumLatencyBuckets = 24
+
+	// Upper bound of the first flush latency bucket. Each subsequent bucket
+	// doubles the bound.
+	MinLatencyBucket = time.Microsecond
+)
+
+// LatencyHistogram counts flushes by latency. Bucket i counts latencies less
+// than LatencyBucketLimit(i), and greater than or equal to the limit of bucket
+// i-1. The last bucket counts all latencies above the second last limit.
+type LatencyHistogram [NumLatencyBuckets]uint64
+
+// LatencyBucketLimit returns the upper bound (exclusive) of latencies counted
+// in bucket i.
+func LatencyBucketLimit(i int) time.Duration {
+	return MinLatencyBucket << uint(i)
+}
+
+func (h *LatencyHistogram) add(d time.Duration) {
+	i := 0
+	for i < NumLatencyBuckets-1 && d >= LatencyBucketLimit(i) {
+		i++
+	}
+	h[i]++
+}
+
+type Stats struct {
+	// Number of bytes written to the underlying writer.
+	BytesWritten uint64
+
+	// Number of buffers written to the underlying writer.
+	Flushes uint64
+
+	// Total time spent by callers of Write blocked waiting for buffer space.
+	BlockedTime time.Duration
+
+	// Distribution of time taken to write a buffer to the underlying writer.
+	FlushLatency LatencyHistogram
+
+	// Number of bytes currently buffered, and the total buffer size.
+	Buffered, Size int
+
+	// Number of buffers currently holding data.
+	BuffersInUse int
+}
+
+// Stats returns a snapshot of the writer's statistics.
+func (w *Writer) Stats() Stats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	s := w.stats
+	s.Buffered, s.BuffersInUse = w.buffered()
+	for _, b := range w.bufs {
+		s.Size += cap(b)
+	}
+	return s
+}
@@ -1,107 +1,442 @@
 package backgroundflush
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 )
 
+const (
+	DefaultNumBuffers = 2
+)
+
+var (
+	ErrClosed = errors.New("backgroundflush: closed")
+)
+
+type Options struct {
+	// Total buffer size, split evenly between all buffers.
+	Size int
+
+	// Number of buffers. While one buffer is being flushed, writes continue
+	// into the remaining buffers. If zero, DefaultNumBuffers is used.
+	NumBuffers int
+
+	// Maximum time data may sit in a partially filled buffer before a
+	// background flush is started. If zero, partially filled buffers are only
+	// flushed by Flush and Close.
+	MaxLatency time.Duration
+
+	// If true, Flush and Close also call the Flush (or if not available, Sync)
+	// method of the underlying writer, after all buffered data has been
+	// written. Useful for *bufio.Writer and *os.File.
+	FlushDownstream bool
+
+	// If true, data which could not be written due to an error is retained,
+	// and written to the new writer after a call to Reset. Otherwise, buffered
+	// data is discarded on error.
+	RetainOnError bool
+}
+
+type flusher interface {
+	Flush() error
+}
+
+type syncer interface {
+	Sync() error
+}
+
 type Writer struct {
 	w io.Writer
 
 	writeBuf, flushBuf int
 	flushActive        bool
 	flushErr           error
-	bufs               [2][]byte
+	closed             bool
+	bufs               [][]byte
+
+	// Downstream flushing. syncReq is the buffer index up to which a
+	// downstream flush has been requested, and syncDone the index up to which
+	// it has completed.
+	downstreamFlush   bool
+	syncReq, syncDone int
+
+	retainOnError bool
+
+	maxLatency   time.Duration
+	bufStart     time.Time
+	latencyTimer *time.Timer
+	timerActive  bool
+
+	stats Stats
 
 	lock sync.Mutex
 	cond *sync.Cond
 }
 
 func NewWriter(w io.Writer, size int) *Writer {
+	return NewWriterWithOptions(w, &Options{Size: size})
+}
+
+func NewWriterWithOptions(w io.Writer, opts *Options) *Writer {
+	numBufs := opts.NumBuffers
+	if numBufs == 0 {
+		numBufs = DefaultNumBuffers
+	} else if numBufs < 0 {
+		panic("backgroundflush: negative NumBuffers")
+	}
+	bufSize := opts.Size / numBufs
+	if bufSize < 1 {
+		bufSize = 1
+	}
+
 	wr := &Writer{
-		w: w,
+		w:          w,
+		bufs:       make([][]byte, numBufs),
+		maxLatency: opts.MaxLatency,
+
+		downstreamFlush: opts.FlushDownstream,
+		retainOnError:   opts.RetainOnError,
 	}
 	wr.cond = sync.NewCond(&wr.lock)
 	for i := range wr.bufs {
-		wr.bufs[i] = make([]byte, 0, size/len(wr.bufs))
+		wr.bufs[i] = make([]byte, 0, bufSize)
 	}
 	return wr
 }
 
+func (w *Writer) buf(i int) *[]byte {
+	return &w.bufs[i%len(w.bufs)]
+}
+
+func (w *Writer) err() error {
+	if w.flushErr != nil {
+		return w.flushErr
+	} else if w.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (w *Writer) startLatencyTimer(d time.Duration) {
+	w.timerActive = true
+	if w.latencyTimer == nil {
+		w.latencyTimer = time.AfterFunc(d, w.latencyFlush)
+	} else {
+		w.latencyTimer.Reset(d)
+	}
+}
+
+func (w *Writer) latencyFlush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.timerActive = false
+	if w.err() != nil {
+		return
+	}
+	// If all buffers are waiting to be flushed, there's no partially filled
+	// buffer.
+	if w.writeBuf < w.flushBuf+len(w.bufs) && len(*w.buf(w.writeBuf)) > 0 {
+		age := time.Since(w.bufStart)
+		if age >= w.maxLatency {
+			w.startFlush(false)
+		} else {
+			w.startLatencyTimer(w.maxLatency - age)
+		}
+	}
+}
+
+// writeFull writes all of b to the underlying writer, retrying short writes.
+// Returns the number of bytes written.
+func (w *Writer) writeFull(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.w.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		} else if n == 0 {
+			// No progress, so assume no progress will ever be made.
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) syncDownstream() error {
+	switch d := w.w.(type) {
+	case flusher:
+		return d.Flush()
+	case syncer:
+		return d.Sync()
+	}
+	return nil
+}
+
 func (w *Writer) doFlush() {
 	w.lock.Lock()
 	defer func() {
 		w.flushActive = false
+		w.cond.Broadcast()
 		w.lock.Unlock()
 	}()
 
-	for w.flushErr == nil && w.writeBuf > w.flushBuf {
-		b := w.bufs[w.flushBuf%2]
+	for w.flushErr == nil && (w.writeBuf > w.flushBuf || w.syncReq > w.syncDone) {
+		// Sync as soon as the requested buffers are written, without waiting
+		// for the flusher to drain, since concurrent writers may prevent that.
+		if w.syncReq > w.syncDone && w.flushBuf >= w.syncReq {
+			target := w.syncReq
+
+			w.lock.Unlock()
+			err := w.syncDownstream()
+			w.lock.Lock()
+
+			w.flushErr = err
+			w.syncDone = target
+			w.cond.Broadcast()
+			continue
+		}
+
+		b := *w.buf(w.flushBuf)
 
 		w.lock.Unlock()
-		_, err := w.w.Write(b)
+		startTime := time.Now()
+		n, err := w.writeFull(b)
+		latency := time.Since(startTime)
 		w.lock.Lock()
 
-		w.bufs[w.flushBuf%2] = b[:0]
+		w.stats.BytesWritten += uint64(n)
+		w.stats.Flushes++
+		w.stats.FlushLatency.add(latency)
+
 		w.flushErr = err
-		w.flushBuf++
+		if err != nil && w.retainOnError {
+			// Keep the unwritten data for a retry after Reset.
+			*w.buf(w.flushBuf) = b[:copy(b, b[n:])]
+		} else {
+			*w.buf(w.flushBuf) = b[:0]
+			w.flushBuf++
+		}
 		w.cond.Broadcast()
 	}
 }
 
-func (w *Writer) startFlush(wait bool) {
-	if w.writeBuf < w.flushBuf+2 && len(w.bufs[w.writeBuf%2]) > 0 {
+// startFlush starts flushing all buffered data, and returns the buffer index
+// which must be flushed for all currently buffered data to be written. If sync
+// is true, a downstream flush is also requested.
+func (w *Writer) startFlush(sync bool) int {
+	if w.writeBuf < w.flushBuf+len(w.bufs) && len(*w.buf(w.writeBuf)) > 0 {
 		w.writeBuf++
 	}
 
 	target := w.writeBuf
+	if sync && w.syncReq < target {
+		w.syncReq = target
+	}
 	if !w.flushActive {
 		w.flushActive = true
 		go w.doFlush()
 	}
-	for wait && w.flushErr == nil && w.flushBuf < target {
+	return target
+}
+
+// waitFlush waits until buffer index target has been flushed, or a flush error
+// occurs, or ctx is done.
+func (w *Writer) waitFlush(ctx context.Context, target int, sync bool) error {
+	defer w.watchContext(ctx)()
+
+	for w.flushErr == nil && (w.flushBuf < target || (sync && w.syncDone < target)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		w.cond.Wait()
 	}
+	return w.flushErr
+}
+
+// watchContext wakes up all waiters when ctx is done, so that waits on w.cond
+// can be cancelled. The returned function MUST be called to stop watching ctx.
+func (w *Writer) watchContext(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.lock.Lock()
+			w.cond.Broadcast()
+			w.lock.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Buffered returns the number of bytes buffered, and not yet written to the
+// underlying writer.
+func (w *Writer) Buffered() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n, _ := w.buffered()
+	return n
+}
+
+// buffered returns the number of bytes buffered, and the number of buffers
+// holding that data.
+func (w *Writer) buffered() (n, bufs int) {
+	end := w.writeBuf + 1
+	if end > w.flushBuf+len(w.bufs) {
+		// All buffers are full, and the write buffer aliases the flush buffer.
+		end = w.flushBuf + len(w.bufs)
+	}
+	for i := w.flushBuf; i < end; i++ {
+		if l := len(*w.buf(i)); l > 0 {
+			n += l
+			bufs++
+		}
+	}
+	return n, bufs
+}
+
+// Reset clears any error or closed state, and switches the underlying writer
+// to wr. Any in-progress flush to the previous writer is completed first. If
+// Options.RetainOnError is set, data which was not written to the previous
+// writer is written to wr. Otherwise, it is discarded.
+func (w *Writer) Reset(wr io.Writer) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for w.flushActive {
+		w.cond.Wait()
+	}
+
+	w.w = wr
+	w.flushErr = nil
+	w.closed = false
+	if !w.retainOnError {
+		for i := range w.bufs {
+			w.bufs[i] = w.bufs[i][:0]
+		}
+		w.writeBuf = w.flushBuf
+	}
+	w.syncReq = w.flushBuf
+	w.syncDone = w.flushBuf
+
+	if w.writeBuf > w.flushBuf {
+		w.startFlush(false)
+	}
+	w.cond.Broadcast()
 }
 
 func (w *Writer) Flush() error {
+	return w.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but returns ctx.Err() if ctx is done before
+// flushing has completed. Flushing continues in the background.
+func (w *Writer) FlushContext(ctx context.Context) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	if w.flushErr != nil {
-		return w.flushErr
+	if err := w.err(); err != nil {
+		return err
 	}
-	w.startFlush(true)
-	return w.flushErr
+	target := w.startFlush(w.downstreamFlush)
+	return w.waitFlush(ctx, target, w.downstreamFlush)
+}
+
+// Close flushes all buffered data, and closes the underlying writer if it
+// implements io.Closer.
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	if w.flushErr == nil {
+		target := w.startFlush(w.downstreamFlush)
+		w.waitFlush(context.Background(), target, w.downstreamFlush)
+	}
+	if w.latencyTimer != nil {
+		w.latencyTimer.Stop()
+		w.timerActive = false
+	}
+	err := w.flushErr
+	w.lock.Unlock()
+
+	if c, ok := w.w.(io.Closer); ok {
+		closeErr := c.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 func (w *Writer) Write(b []byte) (int, error) {
+	return w.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but returns ctx.Err() if ctx is done while
+// waiting for buffer space. In that case, the returned count is the number of
+// bytes which were buffered, and will be flushed.
+func (w *Writer) WriteContext(ctx context.Context, b []byte) (int, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	var stopWatch func()
+	defer func() {
+		if stopWatch != nil {
+			stopWatch()
+		}
+	}()
+
 	n := 0
-	for len(b) > 0 && w.flushErr == nil {
-		if w.writeBuf > w.flushBuf+1 {
-			if w.writeBuf > w.flushBuf+2 {
+	for len(b) > 0 && w.err() == nil {
+		if w.writeBuf >= w.flushBuf+len(w.bufs) {
+			if w.writeBuf > w.flushBuf+len(w.bufs) {
 				panic(fmt.Sprintf("unexpected writeBuf %d, flushBuf %d", w.writeBuf, w.flushBuf))
 			}
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+			if stopWatch == nil {
+				stopWatch = w.watchContext(ctx)
+			}
+			startTime := time.Now()
 			w.cond.Wait()
+			w.stats.BlockedTime += time.Since(startTime)
 			continue
 		}
 
-		wb := w.bufs[w.writeBuf%2]
-		rem := cap(wb) - len(wb)
+		wb := w.buf(w.writeBuf)
+		rem := cap(*wb) - len(*wb)
 		writeLen := len(b)
 		if writeLen > rem {
 			writeLen = rem
 		}
-		w.bufs[w.writeBuf%2] = append(wb, b[:writeLen]...)
+		if len(*wb) == 0 && w.maxLatency > 0 {
+			w.bufStart = time.Now()
+			if !w.timerActive {
+				w.startLatencyTimer(w.maxLatency)
+			}
+		}
+		*wb = append(*wb, b[:writeLen]...)
 		n += writeLen
 		b = b[writeLen:]
-		if len(w.bufs[w.writeBuf%2]) == cap(w.bufs[w.writeBuf%2]) {
+		if len(*wb) == cap(*wb) {
 			w.startFlush(false)
 		}
 	}
 
+	if len(b) > 0 {
+		return n, w.err()
+	}
 	return n, w.flushErr
 }
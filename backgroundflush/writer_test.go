@@ -1,10 +1,16 @@
 package backgroundflush
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type seqWriter struct {
@@ -23,11 +29,24 @@ func (r *seqWriter) Write(buf []byte) (int, error) {
 }
 
 func TestWriter(t *testing.T) {
-	// Both prime numbers.
-	const maxByte = 127
+	// Prime number, like seqMaxByte.
 	const bufSize = 1021
 
-	w := NewWriter(&seqWriter{maxByte: maxByte}, bufSize)
+	testWriterSeq(t, NewWriter(&seqWriter{maxByte: seqMaxByte}, bufSize))
+}
+
+func TestWriterNumBuffers(t *testing.T) {
+	for _, numBufs := range []int{1, 3, 8} {
+		opts := &Options{Size: 4093, NumBuffers: numBufs}
+		testWriterSeq(t, NewWriterWithOptions(&seqWriter{maxByte: seqMaxByte}, opts))
+	}
+}
+
+// Prime number, to avoid alignment with buffer sizes.
+const seqMaxByte = 127
+
+func testWriterSeq(t *testing.T, w *Writer) {
+	const maxByte = seqMaxByte
 
 	buf := make([]byte, 256)
 	for i := 0; i < 1024*1024; {
@@ -109,3 +128,422 @@ func TestWriterError(t *testing.T) {
 		t.Error("expected flush error")
 	}
 }
+
+type closeWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *closeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestWriterClose(t *testing.T) {
+	cw := &closeWriter{}
+	w := NewWriter(cw, 1000)
+	w.Write([]byte("hello world"))
+	err := w.Close()
+	if err != nil {
+		t.Errorf("unexpected close error %v", err)
+	}
+	if !cw.closed {
+		t.Error("underlying writer not closed")
+	}
+	if cw.String() != "hello world" {
+		t.Errorf("written data %q != %q", cw.String(), "hello world")
+	}
+
+	_, err = w.Write([]byte("foo"))
+	if err != ErrClosed {
+		t.Errorf("write error %v != ErrClosed", err)
+	}
+	err = w.Flush()
+	if err != ErrClosed {
+		t.Errorf("flush error %v != ErrClosed", err)
+	}
+	err = w.Close()
+	if err != ErrClosed {
+		t.Errorf("close error %v != ErrClosed", err)
+	}
+}
+
+type chanWriter chan []byte
+
+func (w chanWriter) Write(buf []byte) (int, error) {
+	w <- append([]byte(nil), buf...)
+	return len(buf), nil
+}
+
+func TestWriterMaxLatency(t *testing.T) {
+	const maxLatency = 50 * time.Millisecond
+
+	ch := make(chanWriter, 10)
+	w := NewWriterWithOptions(ch, &Options{Size: 1000, MaxLatency: maxLatency})
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		startTime := time.Now()
+		w.Write([]byte("hello"))
+		w.Write([]byte(" world"))
+		select {
+		case b := <-ch:
+			if string(b) != "hello world" {
+				t.Errorf("written data %q != %q", b, "hello world")
+			}
+			if time.Since(startTime) < maxLatency {
+				t.Errorf("flush after %v, expected >= %v", time.Since(startTime), maxLatency)
+			}
+		case <-time.After(10 * maxLatency):
+			t.Fatal("timed out waiting for background flush")
+		}
+	}
+}
+
+type shortWriter struct {
+	bytes.Buffer
+	maxWrite int
+}
+
+func (w *shortWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.maxWrite {
+		buf = buf[:w.maxWrite]
+	}
+	return w.Buffer.Write(buf)
+}
+
+func TestWriterShortWrite(t *testing.T) {
+	sw := &shortWriter{maxWrite: 7}
+	w := NewWriter(sw, 1000)
+	w.Write([]byte("hello world"))
+	err := w.Flush()
+	if err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if sw.String() != "hello world" {
+		t.Errorf("written data %q != %q", sw.String(), "hello world")
+	}
+
+	sw = &shortWriter{maxWrite: 0}
+	w = NewWriter(sw, 1000)
+	w.Write([]byte("hello world"))
+	err = w.Flush()
+	if err != io.ErrShortWrite {
+		t.Errorf("flush error %v != io.ErrShortWrite", err)
+	}
+}
+
+type syncWriter struct {
+	nopWriter
+	syncs int
+}
+
+func (w *syncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestWriterFlushDownstream(t *testing.T) {
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+	w := NewWriterWithOptions(bw, &Options{Size: 1000, FlushDownstream: true})
+	w.Write([]byte("hello world"))
+	err := w.Flush()
+	if err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if out.String() != "hello world" {
+		t.Errorf("written data %q != %q", out.String(), "hello world")
+	}
+
+	sw := &syncWriter{}
+	w = NewWriterWithOptions(sw, &Options{Size: 1000, FlushDownstream: true})
+	w.Flush()
+	if sw.syncs != 0 {
+		t.Errorf("syncs %d != 0 with no data written", sw.syncs)
+	}
+	w.Write([]byte("hello world"))
+	w.Flush()
+	w.Flush()
+	if sw.syncs != 1 {
+		t.Errorf("syncs %d != 1", sw.syncs)
+	}
+	w.Write([]byte("hello world"))
+	w.Close()
+	if sw.syncs != 2 {
+		t.Errorf("syncs %d != 2", sw.syncs)
+	}
+
+	// Without FlushDownstream, the bufio.Writer is never flushed.
+	out.Reset()
+	bw = bufio.NewWriter(&out)
+	w = NewWriter(bw, 1000)
+	w.Write([]byte("hello world"))
+	w.Flush()
+	if out.Len() != 0 {
+		t.Errorf("unexpected downstream flush")
+	}
+}
+
+type blockingWriter struct {
+	bytes.Buffer
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(buf []byte) (int, error) {
+	<-w.unblock
+	return w.Buffer.Write(buf)
+}
+
+func TestWriterContext(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := NewWriterWithOptions(bw, &Options{Size: 20, NumBuffers: 2})
+
+	// Fill both buffers, causing the flusher to block.
+	n, err := w.WriteContext(context.Background(), []byte("0123456789abcdefghij"))
+	if n != 20 || err != nil {
+		t.Errorf("WriteContext() = %d, %v", n, err)
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cf()
+	n, err = w.WriteContext(ctx, []byte("klmno"))
+	if n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("WriteContext() = %d, %v, expected DeadlineExceeded", n, err)
+	}
+	err = w.FlushContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("FlushContext() = %v, expected DeadlineExceeded", err)
+	}
+
+	close(bw.unblock)
+	w.Write([]byte("KLMNO"))
+	err = w.Flush()
+	if err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if bw.String() != "0123456789abcdefghijKLMNO" {
+		t.Errorf("written data %q", bw.String())
+	}
+}
+
+func TestWriterContextCancel(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := NewWriterWithOptions(bw, &Options{Size: 2, NumBuffers: 2})
+	w.Write([]byte("01"))
+
+	ctx, cf := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := w.WriteContext(ctx, []byte("2"))
+		errCh <- err
+	}()
+	go func() {
+		errCh <- w.FlushContext(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cf()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != context.Canceled {
+			t.Errorf("error %v != context.Canceled", err)
+		}
+	}
+
+	close(bw.unblock)
+	if err := w.Flush(); err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if bw.String() != "01" {
+		t.Errorf("written data %q != %q", bw.String(), "01")
+	}
+}
+
+type failingWriter struct {
+	bytes.Buffer
+	maxWrite int
+}
+
+func (w *failingWriter) Write(buf []byte) (int, error) {
+	if len(buf) > w.maxWrite {
+		n, _ := w.Buffer.Write(buf[:w.maxWrite])
+		return n, errors.New("failingWriter Write error")
+	}
+	return w.Buffer.Write(buf)
+}
+
+func TestWriterBuffered(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := NewWriterWithOptions(bw, &Options{Size: 30, NumBuffers: 3})
+	if w.Buffered() != 0 {
+		t.Errorf("Buffered() %d != 0", w.Buffered())
+	}
+	w.Write([]byte("0123456789abcdefghijklmnopqrst"))
+	if w.Buffered() != 30 {
+		t.Errorf("Buffered() %d != 30", w.Buffered())
+	}
+
+	close(bw.unblock)
+	w.Flush()
+	if w.Buffered() != 0 {
+		t.Errorf("Buffered() %d != 0", w.Buffered())
+	}
+}
+
+func TestWriterResetRetain(t *testing.T) {
+	fw := &failingWriter{maxWrite: 3}
+	w := NewWriterWithOptions(fw, &Options{Size: 100, RetainOnError: true})
+	w.Write([]byte("hello world"))
+	err := w.Flush()
+	if err == nil {
+		t.Error("expected flush error")
+	}
+	if fw.String() != "hel" {
+		t.Errorf("written data %q != %q", fw.String(), "hel")
+	}
+	if w.Buffered() != 8 {
+		t.Errorf("Buffered() %d != 8", w.Buffered())
+	}
+	_, err = w.Write([]byte("foo"))
+	if err == nil {
+		t.Error("expected write error")
+	}
+
+	var out bytes.Buffer
+	w.Reset(&out)
+	w.Write([]byte("!"))
+	err = w.Flush()
+	if err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if out.String() != "lo world!" {
+		t.Errorf("written data %q != %q", out.String(), "lo world!")
+	}
+}
+
+func TestWriterResetDiscard(t *testing.T) {
+	fw := &failingWriter{maxWrite: 3}
+	w := NewWriter(fw, 100)
+	w.Write([]byte("hello world"))
+	err := w.Flush()
+	if err == nil {
+		t.Error("expected flush error")
+	}
+
+	var out bytes.Buffer
+	w.Reset(&out)
+	if w.Buffered() != 0 {
+		t.Errorf("Buffered() %d != 0", w.Buffered())
+	}
+	w.Write([]byte("foo"))
+	err = w.Flush()
+	if err != nil {
+		t.Errorf("unexpected flush error %v", err)
+	}
+	if out.String() != "foo" {
+		t.Errorf("written data %q != %q", out.String(), "foo")
+	}
+}
+
+func TestWriterStats(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := NewWriterWithOptions(bw, &Options{Size: 20, NumBuffers: 2})
+
+	w.Write([]byte("0123456789abcde"))
+	s := w.Stats()
+	if s.Buffered != 15 || s.BuffersInUse != 2 || s.Size != 20 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(bw.unblock)
+	}()
+	// Blocks until the first buffer is flushed.
+	w.Write([]byte("fghijklmno"))
+	w.Flush()
+
+	s = w.Stats()
+	if s.BytesWritten != 25 || s.Flushes != 3 {
+		t.Errorf("BytesWritten %d != 25 or Flushes %d != 3", s.BytesWritten, s.Flushes)
+	}
+	if s.Buffered != 0 || s.BuffersInUse != 0 {
+		t.Errorf("Buffered %d, BuffersInUse %d, expected 0", s.Buffered, s.BuffersInUse)
+	}
+	if s.BlockedTime < 5*time.Millisecond {
+		t.Errorf("BlockedTime %v too short", s.BlockedTime)
+	}
+	var count, slowCount uint64
+	for i, c := range s.FlushLatency {
+		count += c
+		if i == NumLatencyBuckets-1 || LatencyBucketLimit(i) > 5*time.Millisecond {
+			slowCount += c
+		}
+	}
+	if count != s.Flushes {
+		t.Errorf("latency count %d != Flushes %d", count, s.Flushes)
+	}
+	// The first flush was blocked for 10ms.
+	if slowCount < 1 {
+		t.Errorf("no slow flushes in latency histogram %v", s.FlushLatency)
+	}
+}
+
+// slowSyncWriter sleeps on each write, and counts syncs.
+type slowSyncWriter struct {
+	syncs int32
+}
+
+func (w *slowSyncWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(b), nil
+}
+
+func (w *slowSyncWriter) Sync() error {
+	atomic.AddInt32(&w.syncs, 1)
+	return nil
+}
+
+func TestWriterFlushDownstreamConcurrent(t *testing.T) {
+	sw := &slowSyncWriter{}
+	w := NewWriterWithOptions(sw, &Options{Size: 16, NumBuffers: 4, FlushDownstream: true})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 8)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			w.Write(buf)
+		}
+	}()
+
+	// Flush must not wait for the continuous writer to stop.
+	flushed := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		flushed <- w.Flush()
+	}()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("unexpected flush error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush did not return with a concurrent writer")
+	}
+	if atomic.LoadInt32(&sw.syncs) == 0 {
+		t.Error("downstream not synced")
+	}
+
+	close(stop)
+	<-done
+	if err := w.Close(); err != nil {
+		t.Errorf("unexpected close error %v", err)
+	}
+}
@@ -1,10 +1,29 @@
 package bufferpool
 
+import (
+	"errors"
+	"io"
+)
+
+// Minimum amount of free space made available for each Read call by ReadFrom.
+const minReadSize = 512
+
+var (
+	ErrNegativeRead = errors.New("bufferpool: reader returned negative count from Read")
+)
+
+// Buffer is a variable-sized byte buffer, similar to bytes.Buffer, which
+// allocates its backing storage from the buffer pool. Any concurrent use MUST
+// be externally synchronized.
 type Buffer struct {
 	buf     *[]byte
+	off     int
 	donated bool
 }
 
+// NewBuffer returns a Buffer whose initial contents are buf. buf is never
+// modified by the Buffer, and is copied into a pooled buffer on the first
+// modification.
 func NewBuffer(buf []byte) *Buffer {
 	b := buf[0:len(buf):len(buf)]
 	return &Buffer{
@@ -16,33 +35,173 @@ func NewBuffer(buf []byte) *Buffer {
 }
 
 func (b *Buffer) growIfNecessary(n int) {
-	if b.donated || len(*b.buf)+n > cap(*b.buf) {
-		if b.buf == nil && n < MinBufferSize {
-			n = MinBufferSize
+	if n <= 0 {
+		return
+	}
+	l := b.Len()
+	if b.buf != nil && !b.donated {
+		if len(*b.buf)+n <= cap(*b.buf) {
+			return
+		} else if l+n <= cap(*b.buf) {
+			// Enough space if the unread data is moved to the front.
+			copy(*b.buf, (*b.buf)[b.off:])
+			*b.buf = (*b.buf)[:l]
+			b.off = 0
+			return
 		}
-		newBuf := Get(len(*b.buf) + n)
-		*newBuf = (*newBuf)[:0]
-		*newBuf = append(*newBuf, *b.buf...)
-		if b.buf != nil && !b.donated {
+	}
+
+	size := l + n
+	if b.buf != nil && size < 2*cap(*b.buf) {
+		// Grow geometrically, since buffers larger than the maximum pooled
+		// size are allocated at exactly the requested size.
+		size = 2 * cap(*b.buf)
+	}
+	if size < MinBufferSize {
+		size = MinBufferSize
+	}
+	newBuf := GetUninit(size)
+	*newBuf = (*newBuf)[:0]
+	if b.buf != nil {
+		*newBuf = append(*newBuf, (*b.buf)[b.off:]...)
+		if !b.donated {
 			Put(b.buf)
 		}
-		b.buf = newBuf
-		b.donated = false
 	}
+	b.buf = newBuf
+	b.off = 0
+	b.donated = false
+}
+
+// Grow guarantees space for at least another n bytes to be written without
+// another allocation.
+func (b *Buffer) Grow(n int) {
+	if n < 0 {
+		panic("bufferpool: negative count")
+	}
+	b.growIfNecessary(n)
 }
 
 func (b *Buffer) Write(p []byte) (int, error) {
 	b.growIfNecessary(len(p))
-	*b.buf = append(*b.buf, p...)
+	if len(p) > 0 {
+		*b.buf = append(*b.buf, p...)
+	}
 	return len(p), nil
 }
 
+func (b *Buffer) WriteString(s string) (int, error) {
+	b.growIfNecessary(len(s))
+	if len(s) > 0 {
+		*b.buf = append(*b.buf, s...)
+	}
+	return len(s), nil
+}
+
+func (b *Buffer) WriteByte(c byte) error {
+	b.growIfNecessary(1)
+	*b.buf = append(*b.buf, c)
+	return nil
+}
+
+// ReadFrom reads data from r until EOF and appends it to the buffer, growing
+// the buffer as needed. Any error except io.EOF encountered during the read
+// is returned.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		b.growIfNecessary(minReadSize)
+		l := len(*b.buf)
+		n, err := r.Read((*b.buf)[l:cap(*b.buf)])
+		if n < 0 {
+			panic(ErrNegativeRead)
+		}
+		*b.buf = (*b.buf)[:l+n]
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+// consumed marks n unread bytes as read, and rewinds the buffer once all
+// data has been read.
+func (b *Buffer) consumed(n int) {
+	b.off += n
+	if b.off == len(*b.buf) {
+		*b.buf = (*b.buf)[:0]
+		b.off = 0
+	}
+}
+
+func (b *Buffer) Read(p []byte) (int, error) {
+	if b.Len() == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, (*b.buf)[b.off:])
+	b.consumed(n)
+	return n, nil
+}
+
+// WriteTo writes unread data to w until the buffer is drained or an error
+// occurs.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	l := b.Len()
+	if l == 0 {
+		return 0, nil
+	}
+	n, err := w.Write((*b.buf)[b.off:])
+	if n > l {
+		panic("bufferpool: invalid Write count")
+	}
+	b.consumed(n)
+	if err == nil && n != l {
+		err = io.ErrShortWrite
+	}
+	return int64(n), err
+}
+
+// Truncate discards all but the first n unread bytes from the buffer.
+func (b *Buffer) Truncate(n int) {
+	if n < 0 || n > b.Len() {
+		panic("bufferpool: truncation out of range")
+	}
+	if n == 0 {
+		if b.buf != nil {
+			*b.buf = (*b.buf)[:0]
+		}
+		b.off = 0
+		return
+	}
+	*b.buf = (*b.buf)[:b.off+n]
+}
+
 func (b *Buffer) Len() int {
-	return len(*b.buf)
+	if b.buf == nil {
+		return 0
+	}
+	return len(*b.buf) - b.off
 }
 
+func (b *Buffer) Cap() int {
+	if b.buf == nil {
+		return 0
+	}
+	return cap(*b.buf)
+}
+
+// Bytes returns the unread portion of the buffer. The slice is only valid
+// until the next modification of the buffer.
 func (b *Buffer) Bytes() []byte {
-	return *b.buf
+	if b.buf == nil {
+		return nil
+	}
+	return (*b.buf)[b.off:]
 }
 
 func (b *Buffer) Reset() {
@@ -50,4 +209,6 @@ func (b *Buffer) Reset() {
 		Put(b.buf)
 	}
 	b.buf = nil
+	b.off = 0
+	b.donated = false
 }
@@ -0,0 +1,192 @@
+package bufferpool
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestBufferDonated(t *testing.T) {
+	orig := []byte("hello world")
+	donated := append([]byte(nil), orig...)
+
+	b := NewBuffer(donated[:5])
+	if !bytes.Equal(b.Bytes(), orig[:5]) {
+		t.Errorf("Bytes() %q != %q", b.Bytes(), orig[:5])
+	}
+	b.WriteString("!!")
+	b.WriteByte('?')
+	if !bytes.Equal(donated, orig) {
+		t.Errorf("donated buffer modified: %q", donated)
+	}
+	if string(b.Bytes()) != "hello!!?" {
+		t.Errorf("buffer %q != %q", string(b.Bytes()), "hello!!?")
+	}
+
+	b = NewBuffer(donated)
+	p := make([]byte, 6)
+	if n, err := b.Read(p); n != 6 || err != nil {
+		t.Errorf("Read() = %d, %v", n, err)
+	}
+	b.Truncate(2)
+	b.WriteString("rm")
+	if !bytes.Equal(donated, orig) {
+		t.Errorf("donated buffer modified: %q", donated)
+	}
+	if string(b.Bytes()) != "worm" {
+		t.Errorf("buffer %q != %q", string(b.Bytes()), "worm")
+	}
+	b.Reset()
+}
+
+func TestBufferReadWrite(t *testing.T) {
+	var b Buffer
+	var expected []byte
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, rand.Intn(1024))
+		rand.Read(data)
+		b.Write(data)
+		expected = append(expected, data...)
+
+		p := make([]byte, rand.Intn(1024))
+		n, err := b.Read(p)
+		if len(expected) == 0 && len(p) > 0 {
+			if n != 0 || err != io.EOF {
+				t.Fatalf("Read() = %d, %v, expected EOF", n, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("Read() error %v", err)
+		}
+		if !bytes.Equal(p[:n], expected[:n]) {
+			t.Fatalf("Read() data mismatch")
+		}
+		expected = expected[n:]
+
+		if b.Len() != len(expected) {
+			t.Fatalf("Len() %d != %d", b.Len(), len(expected))
+		}
+		if b.Cap() < b.Len() {
+			t.Fatalf("Cap() %d < Len() %d", b.Cap(), b.Len())
+		}
+	}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Bytes() mismatch")
+	}
+	b.Reset()
+	if b.Len() != 0 || b.Cap() != 0 || b.Bytes() != nil {
+		t.Errorf("buffer not empty after Reset()")
+	}
+}
+
+func TestBufferReadFromWriteTo(t *testing.T) {
+	data := make([]byte, 123456)
+	rand.Read(data)
+
+	var b Buffer
+	n, err := b.ReadFrom(bytes.NewReader(data))
+	if n != int64(len(data)) || err != nil {
+		t.Errorf("ReadFrom() = %d, %v", n, err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("Bytes() mismatch")
+	}
+
+	var out bytes.Buffer
+	n, err = b.WriteTo(&out)
+	if n != int64(len(data)) || err != nil {
+		t.Errorf("WriteTo() = %d, %v", n, err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("WriteTo() data mismatch")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Len() %d != 0", b.Len())
+	}
+	b.Reset()
+}
+
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return w.n, nil
+	}
+	return len(p), nil
+}
+
+func TestBufferWriteToShort(t *testing.T) {
+	b := NewBuffer([]byte("0123456789"))
+	n, err := b.WriteTo(&shortWriter{n: 4})
+	if n != 4 || err != io.ErrShortWrite {
+		t.Errorf("WriteTo() = %d, %v", n, err)
+	}
+	if string(b.Bytes()) != "456789" {
+		t.Errorf("buffer %q != %q", string(b.Bytes()), "456789")
+	}
+}
+
+func TestBufferGrow(t *testing.T) {
+	var b Buffer
+	b.Grow(1000)
+	if b.Cap() < 1000 {
+		t.Errorf("Cap() %d < 1000", b.Cap())
+	}
+	c := b.Cap()
+	for i := 0; i < 1000; i++ {
+		b.WriteByte(byte(i))
+	}
+	if b.Cap() != c {
+		t.Errorf("Cap() %d != %d after writes", b.Cap(), c)
+	}
+	b.Reset()
+}
+
+// chunkReader returns at most 512 bytes per Read.
+type chunkReader struct {
+	r io.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	return r.r.Read(p)
+}
+
+func TestBufferReadFromLarge(t *testing.T) {
+	// Larger than the maximum pooled buffer size.
+	const Size = 20 << 20
+	data := make([]byte, Size)
+	rand.Read(data)
+
+	var b Buffer
+	growths := 0
+	lastCap := 0
+	r := &chunkReader{bytes.NewReader(data)}
+	for {
+		n, err := b.ReadFrom(io.LimitReader(r, 1<<20))
+		if err != nil {
+			t.Fatalf("ReadFrom() error %v", err)
+		}
+		if b.Cap() != lastCap {
+			growths++
+			lastCap = b.Cap()
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Error("Bytes read != written")
+	}
+	if b.Cap() > 2*Size {
+		t.Errorf("Cap() %d too large for size %d", b.Cap(), Size)
+	}
+	if growths > 10 {
+		t.Errorf("Buffer grew %d times", growths)
+	}
+}
@@ -0,0 +1,74 @@
+package bufferpool
+
+import (
+	"sync/atomic"
+)
+
+type refCount struct {
+	count int32
+	buf   *[]byte
+}
+
+// RefBuffer is a reference counted pooled buffer, which can be shared between
+// multiple owners without copying. The backing buffer is returned to the pool
+// when the last reference is released. The buffer contents MUST NOT be
+// modified once shared.
+type RefBuffer struct {
+	rc *refCount
+	b  []byte
+}
+
+// NewRefBuffer returns a RefBuffer of length size, holding a single
+// reference.
+func NewRefBuffer(size int) *RefBuffer {
+	buf := Get(size)
+	return &RefBuffer{
+		rc: &refCount{count: 1, buf: buf},
+		b:  *buf,
+	}
+}
+
+// Bytes returns the data viewed by this buffer. The slice is only valid
+// while a reference is held.
+func (b *RefBuffer) Bytes() []byte {
+	return b.b
+}
+
+func (b *RefBuffer) Len() int {
+	return len(b.b)
+}
+
+// Retain adds a reference to the backing buffer, and returns b. Every call to
+// Retain must be paired with a call to Release.
+func (b *RefBuffer) Retain() *RefBuffer {
+	if atomic.AddInt32(&b.rc.count, 1) <= 1 {
+		panic("bufferpool: Retain on released RefBuffer")
+	}
+	return b
+}
+
+// Release removes a reference to the backing buffer, returning it to the pool
+// if this was the last reference.
+func (b *RefBuffer) Release() {
+	count := atomic.AddInt32(&b.rc.count, -1)
+	if count < 0 {
+		panic("bufferpool: RefBuffer released too many times")
+	} else if count == 0 {
+		Put(b.rc.buf)
+		b.rc.buf = nil
+	}
+}
+
+// Slice returns a view of b[start:end], which shares the backing buffer with
+// b. The returned view holds its own reference, which must be released
+// independently of b.
+func (b *RefBuffer) Slice(start, end int) *RefBuffer {
+	if start < 0 || end < start || end > len(b.b) {
+		panic("bufferpool: slice out of range")
+	}
+	b.Retain()
+	return &RefBuffer{
+		rc: b.rc,
+		b:  b.b[start:end:end],
+	}
+}
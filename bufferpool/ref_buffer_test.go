@@ -0,0 +1,92 @@
+package bufferpool
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestRefBuffer(t *testing.T) {
+	b := NewRefBuffer(100)
+	for i := range b.Bytes() {
+		b.Bytes()[i] = byte(i)
+	}
+
+	s := b.Slice(10, 20)
+	if s.Len() != 10 {
+		t.Errorf("Len() %d != 10", s.Len())
+	}
+	if !bytes.Equal(s.Bytes(), b.Bytes()[10:20]) {
+		t.Errorf("Slice() data mismatch")
+	}
+	if cap(s.Bytes()) != 10 {
+		t.Errorf("cap(Bytes()) %d != 10", cap(s.Bytes()))
+	}
+
+	b.Release()
+	// The slice still holds a reference.
+	if b.rc.buf == nil {
+		t.Errorf("buffer released with outstanding reference")
+	}
+	if s.Bytes()[0] != 10 {
+		t.Errorf("Bytes()[0] %d != 10", s.Bytes()[0])
+	}
+	s.Release()
+	if b.rc.buf != nil {
+		t.Errorf("buffer not released")
+	}
+}
+
+func TestRefBufferOverRelease(t *testing.T) {
+	b := NewRefBuffer(16)
+	b.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic")
+		}
+	}()
+	b.Release()
+}
+
+func TestRefBufferConcurrent(t *testing.T) {
+	const size = 4096
+	const readers = 16
+
+	for i := 0; i < 100; i++ {
+		b := NewRefBuffer(size)
+		for j := range b.Bytes() {
+			b.Bytes()[j] = byte(j)
+		}
+
+		var wg sync.WaitGroup
+		for j := 0; j < readers; j++ {
+			var view *RefBuffer
+			if j%2 == 0 {
+				view = b.Retain()
+			} else {
+				view = b.Slice(j, size)
+			}
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				defer view.Release()
+				for k, v := range view.Bytes() {
+					if j%2 == 1 {
+						k += j
+					}
+					if v != byte(k) {
+						t.Errorf("Bytes()[%d] %d != %d", k, v, byte(k))
+						return
+					}
+				}
+			}(j)
+		}
+		b.Release()
+		wg.Wait()
+
+		if b.rc.count != 0 || b.rc.buf != nil {
+			t.Errorf("buffer not released, count %d", b.rc.count)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package bufferpool
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	DefaultSegmentSize = 64 * 1024
+)
+
+var (
+	ErrNegativeOffset = errors.New("bufferpool: negative offset")
+)
+
+// SegmentedBuffer is an append-only buffer composed of a list of fixed-size
+// pooled segments. Unlike Buffer, growing a SegmentedBuffer never copies
+// existing data. Any concurrent use MUST be externally synchronized.
+//
+// The zero value is an empty buffer using DefaultSegmentSize segments.
+type SegmentedBuffer struct {
+	segSize int
+	segs    []*[]byte
+	length  int
+
+	// Contiguous copy of the buffer, created on demand by Bytes().
+	flat *[]byte
+}
+
+func NewSegmentedBuffer(segSize int) *SegmentedBuffer {
+	if segSize <= 0 {
+		segSize = DefaultSegmentSize
+	} else if segSize < MinBufferSize {
+		segSize = MinBufferSize
+	}
+	return &SegmentedBuffer{segSize: segSize}
+}
+
+func (b *SegmentedBuffer) segmentSize() int {
+	if b.segSize == 0 {
+		b.segSize = DefaultSegmentSize
+	}
+	return b.segSize
+}
+
+func (b *SegmentedBuffer) releaseFlat() {
+	if b.flat != nil {
+		Put(b.flat)
+		b.flat = nil
+	}
+}
+
+func (b *SegmentedBuffer) Write(p []byte) (int, error) {
+	segSize := b.segmentSize()
+	if len(p) > 0 {
+		b.releaseFlat()
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(b.segs) == 0 || len(*b.segs[len(b.segs)-1]) == segSize {
+			seg := GetUninit(segSize)
+			*seg = (*seg)[:0]
+			b.segs = append(b.segs, seg)
+		}
+		seg := b.segs[len(b.segs)-1]
+		writeLen := segSize - len(*seg)
+		if writeLen > len(p) {
+			writeLen = len(p)
+		}
+		*seg = append(*seg, p[:writeLen]...)
+		p = p[writeLen:]
+		n += writeLen
+		b.length += writeLen
+	}
+	return n, nil
+}
+
+func (b *SegmentedBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	} else if off >= int64(b.length) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	segSize := int64(b.segmentSize())
+	n := 0
+	for n < len(p) && off < int64(b.length) {
+		seg := *b.segs[off/segSize]
+		copied := copy(p[n:], seg[off%segSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo writes the contents of the buffer to w. If w supports it (i.e.
+// net.Conn), the write is done using a single writev system call. The buffer
+// is not modified.
+func (b *SegmentedBuffer) WriteTo(w io.Writer) (int64, error) {
+	bufs := make(net.Buffers, len(b.segs))
+	for i, seg := range b.segs {
+		bufs[i] = *seg
+	}
+	return bufs.WriteTo(w)
+}
+
+func (b *SegmentedBuffer) Len() int {
+	return b.length
+}
+
+// Bytes returns the contents of the buffer as a contiguous slice. If the
+// buffer is composed of more than one segment, the contents are copied into a
+// flattened buffer. The returned slice is only valid until the next
+// modification of the buffer.
+func (b *SegmentedBuffer) Bytes() []byte {
+	if len(b.segs) == 0 {
+		return nil
+	} else if len(b.segs) == 1 {
+		return *b.segs[0]
+	}
+
+	if b.flat == nil {
+		b.flat = GetUninit(b.length)
+		off := 0
+		for _, seg := range b.segs {
+			off += copy((*b.flat)[off:], *seg)
+		}
+	}
+	return *b.flat
+}
+
+// Reset empties the buffer and returns all segments to the pool.
+func (b *SegmentedBuffer) Reset() {
+	b.releaseFlat()
+	for i, seg := range b.segs {
+		Put(seg)
+		b.segs[i] = nil
+	}
+	b.segs = b.segs[:0]
+	b.length = 0
+}
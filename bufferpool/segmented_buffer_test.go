@@ -0,0 +1,94 @@
+package bufferpool
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestSegmentedBuffer(t *testing.T) {
+	const segSize = 1024
+
+	b := NewSegmentedBuffer(segSize)
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		data := make([]byte, rand.Intn(3*segSize))
+		rand.Read(data)
+		n, err := b.Write(data)
+		if n != len(data) || err != nil {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+		expected = append(expected, data...)
+		if b.Len() != len(expected) {
+			t.Fatalf("Len() %d != %d", b.Len(), len(expected))
+		}
+	}
+
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Bytes() mismatch")
+	}
+
+	for i := 0; i < 1000; i++ {
+		off := rand.Intn(len(expected))
+		p := make([]byte, rand.Intn(3*segSize))
+		n, err := b.ReadAt(p, int64(off))
+		expectedLen := len(p)
+		if off+expectedLen > len(expected) {
+			expectedLen = len(expected) - off
+			if err != io.EOF {
+				t.Errorf("ReadAt() error %v, expected EOF", err)
+			}
+		} else if err != nil {
+			t.Errorf("ReadAt() error %v", err)
+		}
+		if n != expectedLen {
+			t.Errorf("ReadAt() n %d != %d", n, expectedLen)
+		}
+		if !bytes.Equal(p[:n], expected[off:off+n]) {
+			t.Errorf("ReadAt() data mismatch at offset %d", off)
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := b.WriteTo(&out)
+	if n != int64(len(expected)) || err != nil {
+		t.Errorf("WriteTo() = %d, %v", n, err)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("WriteTo() data mismatch")
+	}
+
+	b.Reset()
+	if b.Len() != 0 || b.Bytes() != nil {
+		t.Errorf("buffer not empty after Reset()")
+	}
+	if n, err := b.ReadAt(make([]byte, 1), 0); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt() = %d, %v, expected EOF", n, err)
+	}
+}
+
+func TestSegmentedBufferZeroValue(t *testing.T) {
+	var b SegmentedBuffer
+	b.Write([]byte("hello"))
+	b.Write([]byte(" world"))
+	if string(b.Bytes()) != "hello world" {
+		t.Errorf("Bytes() %q != %q", b.Bytes(), "hello world")
+	}
+	b.Reset()
+}
+
+func BenchmarkSegmentedBufferWrite(b *testing.B) {
+	const size = 8 * 1024 * 1024
+	data := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		var buf SegmentedBuffer
+		for buf.Len() < size {
+			buf.Write(data)
+		}
+		buf.Reset()
+	}
+}
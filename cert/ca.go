@@ -0,0 +1,145 @@
+package cert
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	DefaultCAExpiryPeriod = 365 * 24 * time.Hour
+)
+
+var (
+	ErrNotCA        = errors.New("cert: certificate is not a CA")
+	ErrNoPrivateKey = errors.New("cert: missing private key")
+)
+
+// CA is a private certificate authority, which issues leaf certificates
+// signed by its root certificate.
+type CA struct {
+	cert *tls.Certificate
+}
+
+// NewCA generates a new self-signed root CA certificate. If opts.Expiry is
+// zero, the certificate expires after DefaultCAExpiryPeriod. opts.IsCA is
+// ignored.
+func NewCA(opts Options) (*CA, error) {
+	if opts.Expiry.IsZero() {
+		opts.Expiry = time.Now().Add(DefaultCAExpiryPeriod)
+	}
+	opts.IsCA = true
+	if err := ensurePrivateKey(&opts); err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(&opts)
+	if err != nil {
+		return nil, err
+	}
+	template.MaxPathLenZero = true
+	if opts.KeyUsage == 0 {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	}
+	if opts.ExtKeyUsage == nil {
+		template.ExtKeyUsage = nil
+	}
+
+	cert, err := createCert(template, template, opts.PrivateKey, opts.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert}, nil
+}
+
+// LoadCA returns a CA which uses an existing CA certificate and private key.
+func LoadCA(cert *tls.Certificate) (*CA, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("cert: empty certificate")
+	} else if cert.PrivateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("cert: failed to parse CA certificate: %w", err)
+		}
+	}
+	if !leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, ErrNotCA
+	}
+
+	c := *cert
+	c.Leaf = leaf
+	return &CA{cert: &c}, nil
+}
+
+// Certificate returns the CA's root certificate and private key.
+func (ca *CA) Certificate() *tls.Certificate {
+	return ca.cert
+}
+
+// CertPool returns a certificate pool containing the CA's root certificate,
+// for use as tls.Config.RootCAs or ClientCAs.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert.Leaf)
+	return pool
+}
+
+func (ca *CA) issue(opts Options, extKeyUsage x509.ExtKeyUsage, hosts []string) (*tls.Certificate, error) {
+	if err := ensurePrivateKey(&opts); err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.KeyUsage == 0 {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := opts.PrivateKey.(*rsa.PrivateKey); ok {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+	if opts.ExtKeyUsage == nil {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{extKeyUsage}
+	}
+	// Copy the names, so that appending doesn't modify the caller's slices.
+	template.DNSNames = append([]string(nil), template.DNSNames...)
+	template.IPAddresses = append([]net.IP(nil), template.IPAddresses...)
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if template.NotAfter.After(ca.cert.Leaf.NotAfter) {
+		// Certificates can't outlive their issuer.
+		template.NotAfter = ca.cert.Leaf.NotAfter
+	}
+
+	return createCert(template, ca.cert.Leaf, opts.PrivateKey, ca.cert.PrivateKey, ca.cert.Certificate)
+}
+
+// IssueServer issues a server certificate valid for hosts, which may be DNS
+// names or IP addresses, in addition to any names in opts. If opts.CommonName
+// is empty, the first host is used.
+// The returned certificate chain includes the CA certificate.
+func (ca *CA) IssueServer(opts Options, hosts ...string) (*tls.Certificate, error) {
+	if opts.CommonName == "" && len(hosts) > 0 {
+		opts.CommonName = hosts[0]
+	}
+	return ca.issue(opts, x509.ExtKeyUsageServerAuth, hosts)
+}
+
+// IssueClient issues a client certificate, for use in mutual TLS. The
+// returned certificate chain includes the CA certificate.
+func (ca *CA) IssueClient(opts Options) (*tls.Certificate, error) {
+	return ca.issue(opts, x509.ExtKeyUsageClientAuth, nil)
+}
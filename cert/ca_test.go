@@ -0,0 +1,151 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+func TestCAVerify(t *testing.T) {
+	ca, err := NewCA(Options{CommonName: "Test CA"})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+
+	server, err := ca.IssueServer(Options{}, "example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("IssueServer() error %v", err)
+	}
+	if len(server.Certificate) != 2 {
+		t.Errorf("len(Certificate) %d != 2", len(server.Certificate))
+	}
+	for _, host := range []string{"example.com", "127.0.0.1"} {
+		_, err = server.Leaf.Verify(x509.VerifyOptions{
+			DNSName: host,
+			Roots:   ca.CertPool(),
+		})
+		if err != nil {
+			t.Errorf("Verify(%s) error %v", host, err)
+		}
+	}
+	_, err = server.Leaf.Verify(x509.VerifyOptions{
+		DNSName: "other.com",
+		Roots:   ca.CertPool(),
+	})
+	if err == nil {
+		t.Error("expected verify error for other.com")
+	}
+
+	client, err := ca.IssueClient(Options{CommonName: "client"})
+	if err != nil {
+		t.Fatalf("IssueClient() error %v", err)
+	}
+	_, err = client.Leaf.Verify(x509.VerifyOptions{
+		Roots:     ca.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err == nil {
+		t.Error("expected verify error for client cert used as server cert")
+	}
+
+	loaded, err := LoadCA(&tls.Certificate{
+		Certificate: ca.Certificate().Certificate,
+		PrivateKey:  ca.Certificate().PrivateKey,
+	})
+	if err != nil {
+		t.Fatalf("LoadCA() error %v", err)
+	}
+	if _, err = loaded.IssueClient(Options{}); err != nil {
+		t.Errorf("IssueClient() error %v", err)
+	}
+	if _, err = LoadCA(server); err != ErrNotCA {
+		t.Errorf("LoadCA() error %v != ErrNotCA", err)
+	}
+}
+
+func TestCAMutualTLS(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	server, err := ca.IssueServer(Options{}, "server.test")
+	if err != nil {
+		t.Fatalf("IssueServer() error %v", err)
+	}
+	client, err := ca.IssueClient(Options{CommonName: "client"})
+	if err != nil {
+		t.Fatalf("IssueClient() error %v", err)
+	}
+
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	serverConn := tls.Server(sc, &tls.Config{
+		Certificates: []tls.Certificate{*server},
+		ClientCAs:    ca.CertPool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	clientConn := tls.Client(cc, &tls.Config{
+		Certificates: []tls.Certificate{*client},
+		RootCAs:      ca.CertPool(),
+		ServerName:   "server.test",
+	})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- serverConn.Handshake()
+	}()
+	if err := clientConn.Handshake(); err != nil {
+		t.Errorf("client Handshake() error %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("server Handshake() error %v", err)
+	}
+
+	peerCerts := serverConn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 || peerCerts[0].Subject.CommonName != "client" {
+		t.Errorf("unexpected client certificates %v", peerCerts)
+	}
+}
+
+func TestCAIssueSharedOptions(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+
+	// Spare capacity, so that appending to the options' slices in place would
+	// be visible to the caller and to later certificates.
+	opts := Options{
+		DNSNames:    make([]string, 1, 4),
+		IPAddresses: make([]net.IP, 1, 4),
+	}
+	opts.DNSNames[0] = "shared.test"
+	opts.IPAddresses[0] = net.ParseIP("10.0.0.1")
+
+	a, err := ca.IssueServer(opts, "a.test", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("IssueServer() error %v", err)
+	}
+	b, err := ca.IssueServer(opts, "b.test", "10.0.0.3")
+	if err != nil {
+		t.Fatalf("IssueServer() error %v", err)
+	}
+
+	if got := opts.DNSNames[:cap(opts.DNSNames)][1]; got != "" {
+		t.Errorf("opts.DNSNames backing array modified: %q", got)
+	}
+	if got := opts.IPAddresses[:cap(opts.IPAddresses)][1]; got != nil {
+		t.Errorf("opts.IPAddresses backing array modified: %v", got)
+	}
+	if len(a.Leaf.DNSNames) != 2 || a.Leaf.DNSNames[1] != "a.test" {
+		t.Errorf("first certificate DNSNames %v", a.Leaf.DNSNames)
+	}
+	if len(b.Leaf.DNSNames) != 2 || b.Leaf.DNSNames[1] != "b.test" {
+		t.Errorf("second certificate DNSNames %v", b.Leaf.DNSNames)
+	}
+	if len(a.Leaf.IPAddresses) != 2 || !a.Leaf.IPAddresses[1].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("first certificate IPAddresses %v", a.Leaf.IPAddresses)
+	}
+}
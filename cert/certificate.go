@@ -3,13 +3,18 @@ package cert
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"math/big"
+	"net"
+	"net/url"
 	"time"
 )
 
@@ -20,6 +25,8 @@ const (
 )
 
 var (
+	ErrUnsupportedKeyType = errors.New("cert: unsupported private key type")
+
 	serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
 )
 
@@ -28,9 +35,55 @@ type Options struct {
 	CommonName string
 	Expiry     time.Time
 	PrivateKey crypto.PrivateKey
+
+	// Subject Alternative Names. Hostname verification ignores CommonName,
+	// so certificates used by TLS servers need at least one DNS name or IP
+	// address.
+	DNSNames       []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	EmailAddresses []string
+
+	// Start of the validity period. If zero, the current time is used.
+	NotBefore time.Time
+
+	// If zero, KeyUsageKeyEncipherment | KeyUsageDigitalSignature is used.
+	KeyUsage x509.KeyUsage
+
+	// If nil, ExtKeyUsageAny is used.
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// If true, the certificate can be used to sign other certificates. If
+	// KeyUsage is zero, KeyUsageCertSign is added to the default key usage.
+	IsCA bool
 }
 
-func GenerateCert(opts Options) (cert []byte, privKey crypto.PrivateKey) {
+func publicKey(priv crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey, nil
+	case ed25519.PrivateKey:
+		return k.Public(), nil
+	}
+	return nil, ErrUnsupportedKeyType
+}
+
+// ensurePrivateKey generates an ECDSA P-256 key if opts.PrivateKey is nil.
+func ensurePrivateKey(opts *Options) error {
+	if opts.PrivateKey == nil {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("cert: failed to generate ECDSA key: %w", err)
+		}
+		opts.PrivateKey = priv
+	}
+	return nil
+}
+
+// newTemplate fills in defaults in opts, and returns a certificate template.
+func newTemplate(opts *Options) (*x509.Certificate, error) {
 	if opts.OrgName == "" {
 		opts.OrgName = DefaultOrgName
 	}
@@ -41,47 +94,102 @@ func GenerateCert(opts Options) (cert []byte, privKey crypto.PrivateKey) {
 		opts.Expiry = time.Now().Add(DefaultExpiryPeriod)
 	}
 
-	if opts.PrivateKey == nil {
-		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to generate ECDSA key: %s", err))
-		}
-		opts.PrivateKey = priv
-	}
-
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to generate serial number: %s", err))
+		return nil, fmt.Errorf("cert: failed to generate serial number: %w", err)
 	}
 
-	template := x509.Certificate{
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	keyUsage := opts.KeyUsage
+	if keyUsage == 0 {
+		keyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+		if opts.IsCA {
+			keyUsage |= x509.KeyUsageCertSign
+		}
+	}
+	extKeyUsage := opts.ExtKeyUsage
+	if extKeyUsage == nil {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	}
+
+	return &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{opts.OrgName},
 			CommonName:   opts.CommonName,
 		},
-		NotBefore: time.Now(),
+		NotBefore: notBefore,
 		NotAfter:  opts.Expiry,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		DNSNames:       opts.DNSNames,
+		IPAddresses:    opts.IPAddresses,
+		URIs:           opts.URIs,
+		EmailAddresses: opts.EmailAddresses,
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		IsCA:                  opts.IsCA,
 		BasicConstraintsValid: true,
+	}, nil
+}
+
+// signCert creates a DER encoded certificate from template for pubKey, signed
+// by parent, and returns it along with the parsed certificate.
+func signCert(template, parent *x509.Certificate, pubKey crypto.PublicKey, parentKey crypto.PrivateKey) ([]byte, *x509.Certificate, error) {
+	derCert, err := x509.CreateCertificate(
+		rand.Reader, template, parent, pubKey, parentKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert: failed to generate certificate: %w", err)
 	}
+	leaf, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert: failed to parse generated certificate: %w", err)
+	}
+	return derCert, leaf, nil
+}
 
-	var pubKey crypto.PublicKey
-	switch k := opts.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		pubKey = &k.PublicKey
-	case *ecdsa.PrivateKey:
-		pubKey = &k.PublicKey
-	default:
-		panic("unsupported private key type")
+// createCert creates a certificate from template for privKey, signed by
+// parent. chain is appended to the created certificate.
+func createCert(template, parent *x509.Certificate, privKey, parentKey crypto.PrivateKey, chain [][]byte) (*tls.Certificate, error) {
+	pubKey, err := publicKey(privKey)
+	if err != nil {
+		return nil, err
 	}
-	derCert, err := x509.CreateCertificate(
-		rand.Reader, &template, &template, pubKey, opts.PrivateKey)
+	derCert, leaf, err := signCert(template, parent, pubKey, parentKey)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to generate certificate: %s", err))
+		return nil, err
 	}
 
-	return derCert, opts.PrivateKey
+	return &tls.Certificate{
+		Certificate: append([][]byte{derCert}, chain...),
+		PrivateKey:  privKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Generate generates a self-signed certificate. If opts.PrivateKey is nil, a
+// new ECDSA P-256 key is generated. The returned certificate has Leaf
+// populated.
+func Generate(opts Options) (*tls.Certificate, error) {
+	if err := ensurePrivateKey(&opts); err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return createCert(template, template, opts.PrivateKey, opts.PrivateKey, nil)
+}
+
+// GenerateCert is like Generate, but returns the DER encoded certificate and
+// private key, and panics on error.
+func GenerateCert(opts Options) (cert []byte, privKey crypto.PrivateKey) {
+	c, err := Generate(opts)
+	if err != nil {
+		panic(err)
+	}
+	return c.Certificate[0], c.PrivateKey
 }
@@ -0,0 +1,103 @@
+package cert
+
+import (
+	"crypto/x509"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGenerateHostnames(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/service")
+	c, err := Generate(Options{
+		DNSNames:       []string{"example.com", "*.example.org"},
+		IPAddresses:    []net.IP{net.ParseIP("10.1.2.3"), net.ParseIP("::1")},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{"admin@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+
+	for _, h := range []string{"example.com", "foo.example.org", "10.1.2.3", "::1"} {
+		if err := c.Leaf.VerifyHostname(h); err != nil {
+			t.Errorf("VerifyHostname(%s) error %v", h, err)
+		}
+	}
+	for _, h := range []string{"domain.invalid", "other.com", "example.org", "10.1.2.4"} {
+		if err := c.Leaf.VerifyHostname(h); err == nil {
+			t.Errorf("VerifyHostname(%s) expected error", h)
+		}
+	}
+
+	if len(c.Leaf.URIs) != 1 || c.Leaf.URIs[0].String() != uri.String() {
+		t.Errorf("unexpected URIs %v", c.Leaf.URIs)
+	}
+	if !reflect.DeepEqual(c.Leaf.EmailAddresses, []string{"admin@example.com"}) {
+		t.Errorf("unexpected EmailAddresses %v", c.Leaf.EmailAddresses)
+	}
+}
+
+func TestGenerateKeyUsage(t *testing.T) {
+	c, err := Generate(Options{DNSNames: []string{"example.com"}})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+	if c.Leaf.IsCA {
+		t.Error("unexpected CA certificate")
+	}
+	if !reflect.DeepEqual(c.Leaf.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageAny}) {
+		t.Errorf("unexpected ExtKeyUsage %v", c.Leaf.ExtKeyUsage)
+	}
+
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c, err = Generate(Options{
+		DNSNames:    []string{"example.com"},
+		NotBefore:   notBefore,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+	if !c.Leaf.NotBefore.Equal(notBefore) {
+		t.Errorf("NotBefore %v != %v", c.Leaf.NotBefore, notBefore)
+	}
+	if c.Leaf.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("unexpected KeyUsage %v", c.Leaf.KeyUsage)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(c.Leaf)
+	_, err = c.Leaf.Verify(x509.VerifyOptions{
+		DNSName:   "example.com",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Errorf("Verify() error %v", err)
+	}
+	_, err = c.Leaf.Verify(x509.VerifyOptions{
+		DNSName:   "example.com",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err == nil {
+		t.Error("expected verify error for client auth")
+	}
+}
+
+func TestGenerateIsCA(t *testing.T) {
+	c, err := Generate(Options{IsCA: true})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+	if !c.Leaf.IsCA || c.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Errorf("certificate not a CA, KeyUsage %v", c.Leaf.KeyUsage)
+	}
+	if _, err := LoadCA(c); err != nil {
+		t.Errorf("LoadCA() error %v", err)
+	}
+}
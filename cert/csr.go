@@ -0,0 +1,207 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPolicyViolation  = errors.New("cert: CSR violates signing policy")
+	ErrNegativeValidity = errors.New("cert: negative validity period")
+)
+
+// NewCSR generates a PKCS #10 certificate signing request, using the subject
+// and Subject Alternative Names in opts. If opts.PrivateKey is nil, a new
+// ECDSA P-256 key is generated. Validity and key usage options are ignored,
+// since they are determined by the signer.
+func NewCSR(opts Options) (csr []byte, privKey crypto.PrivateKey, err error) {
+	if opts.OrgName == "" {
+		opts.OrgName = DefaultOrgName
+	}
+	if err := ensurePrivateKey(&opts); err != nil {
+		return nil, nil, err
+	}
+	if _, err := publicKey(opts.PrivateKey); err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{opts.OrgName},
+			CommonName:   opts.CommonName,
+		},
+		DNSNames:       opts.DNSNames,
+		IPAddresses:    opts.IPAddresses,
+		URIs:           opts.URIs,
+		EmailAddresses: opts.EmailAddresses,
+	}
+	csr, err = x509.CreateCertificateRequest(rand.Reader, &template, opts.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert: failed to create CSR: %w", err)
+	}
+	return csr, opts.PrivateKey, nil
+}
+
+// SigningPolicy restricts the certificates issued by CA.SignCSR.
+type SigningPolicy struct {
+	// DNS names which may appear in the certificate. A pattern of the form
+	// "*.example.com" allows any subdomain of example.com. If empty, no DNS
+	// names are allowed.
+	AllowedDNSNames []string
+
+	// If true, requested DNS names may be wildcards of the form
+	// "*.foo.example.com", which must also match AllowedDNSNames. Otherwise,
+	// requested names containing '*' are rejected, so that a pattern allowing
+	// any subdomain doesn't issue certificates valid for all subdomains.
+	AllowWildcards bool
+
+	// Networks containing IP addresses which may appear in the certificate. If
+	// empty, no IP addresses are allowed.
+	AllowedIPNets []*net.IPNet
+
+	// If true, URI and email Subject Alternative Names are allowed.
+	AllowURIs, AllowEmailAddresses bool
+
+	// Maximum validity period of the issued certificate. If zero,
+	// DefaultExpiryPeriod is used.
+	MaxValidity time.Duration
+
+	// Extended key usage of the issued certificate. If nil, both
+	// ExtKeyUsageServerAuth and ExtKeyUsageClientAuth are used.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+func (p *SigningPolicy) dnsNameAllowed(name string) bool {
+	name = strings.ToLower(name)
+	if i := strings.LastIndexByte(name, '*'); i >= 0 {
+		if !p.AllowWildcards || i != 0 || !strings.HasPrefix(name, "*.") {
+			return false
+		}
+	}
+	for _, pattern := range p.AllowedDNSNames {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(name, pattern[1:]) && len(name) > len(pattern)-1 {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *SigningPolicy) ipAllowed(ip net.IP) bool {
+	for _, n := range p.AllowedIPNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *SigningPolicy) check(csr *x509.CertificateRequest) error {
+	// Clients may treat the Common Name as a host name, so it is subject to the
+	// same restrictions as DNS names and IP addresses.
+	if cn := csr.Subject.CommonName; cn != "" {
+		if ip := net.ParseIP(cn); ip != nil {
+			if !p.ipAllowed(ip) {
+				return fmt.Errorf("%w: Common Name %s not allowed", ErrPolicyViolation, cn)
+			}
+		} else if !p.dnsNameAllowed(cn) {
+			return fmt.Errorf("%w: Common Name %s not allowed", ErrPolicyViolation, cn)
+		}
+	}
+	for _, name := range csr.DNSNames {
+		if !p.dnsNameAllowed(name) {
+			return fmt.Errorf("%w: DNS name %s not allowed", ErrPolicyViolation, name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !p.ipAllowed(ip) {
+			return fmt.Errorf("%w: IP address %v not allowed", ErrPolicyViolation, ip)
+		}
+	}
+	if len(csr.URIs) > 0 && !p.AllowURIs {
+		return fmt.Errorf("%w: URIs not allowed", ErrPolicyViolation)
+	}
+	if len(csr.EmailAddresses) > 0 && !p.AllowEmailAddresses {
+		return fmt.Errorf("%w: email addresses not allowed", ErrPolicyViolation)
+	}
+	return nil
+}
+
+// SignCSR validates a DER encoded certificate signing request against policy,
+// and issues a certificate valid for the requested validity period, capped to
+// policy.MaxValidity. If validity is zero, policy.MaxValidity is used, and if
+// negative, ErrNegativeValidity is returned. A non-empty Common Name in the CSR
+// must be allowed by the policy as a DNS name or IP address. The certificate
+// subject contains only the requested Common Name; other subject fields in the
+// CSR are ignored. The returned certificate chain includes the CA certificate.
+// A nil policy is equivalent to an empty SigningPolicy.
+func (ca *CA) SignCSR(csrDER []byte, validity time.Duration, policy *SigningPolicy) ([][]byte, error) {
+	if validity < 0 {
+		return nil, ErrNegativeValidity
+	}
+	if policy == nil {
+		policy = &SigningPolicy{}
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("cert: failed to parse CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("cert: invalid CSR signature: %w", err)
+	}
+	if err := policy.check(csr); err != nil {
+		return nil, err
+	}
+
+	maxValidity := policy.MaxValidity
+	if maxValidity == 0 {
+		maxValidity = DefaultExpiryPeriod
+	}
+	if validity == 0 || validity > maxValidity {
+		validity = maxValidity
+	}
+	extKeyUsage := policy.ExtKeyUsage
+	if extKeyUsage == nil {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	opts := Options{
+		Expiry:         time.Now().Add(validity),
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		EmailAddresses: csr.EmailAddresses,
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    extKeyUsage,
+	}
+	template, err := newTemplate(&opts)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject = pkix.Name{CommonName: csr.Subject.CommonName}
+	if template.NotAfter.After(ca.cert.Leaf.NotAfter) {
+		template.NotAfter = ca.cert.Leaf.NotAfter
+	}
+
+	derCert, _, err := signCert(template, ca.cert.Leaf, csr.PublicKey, ca.cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return append([][]byte{derCert}, ca.cert.Certificate...), nil
+}
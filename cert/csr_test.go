@@ -0,0 +1,142 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSignCSR(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	policy := &SigningPolicy{
+		AllowedDNSNames: []string{"example.com", "*.svc.example.com"},
+		AllowedIPNets:   []*net.IPNet{ipNet},
+		MaxValidity:     time.Hour,
+	}
+
+	csr, key, err := NewCSR(Options{
+		CommonName:  "foo.svc.example.com",
+		OrgName:     "Requested Org",
+		DNSNames:    []string{"example.com", "foo.svc.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+	})
+	if err != nil {
+		t.Fatalf("NewCSR() error %v", err)
+	}
+	chain, err := ca.SignCSR(csr, 24*time.Hour, policy)
+	if err != nil {
+		t.Fatalf("SignCSR() error %v", err)
+	}
+	if len(chain) != 2 {
+		t.Errorf("len(chain) %d != 2", len(chain))
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error %v", err)
+	}
+	if leaf.Subject.CommonName != "foo.svc.example.com" {
+		t.Errorf("CommonName %s != foo.svc.example.com", leaf.Subject.CommonName)
+	}
+	if len(leaf.Subject.Organization) != 0 {
+		t.Errorf("Organization %v copied from CSR", leaf.Subject.Organization)
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > time.Hour+time.Minute {
+		t.Errorf("validity %v exceeds MaxValidity", leaf.NotAfter.Sub(leaf.NotBefore))
+	}
+	for _, h := range []string{"example.com", "foo.svc.example.com", "10.1.2.3"} {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: h, Roots: ca.CertPool()})
+		if err != nil {
+			t.Errorf("Verify(%s) error %v", h, err)
+		}
+	}
+
+	// The signed certificate must pair with the CSR's private key.
+	_, err = DecodePEM(encodePEMPair(t, &tls.Certificate{Certificate: chain, PrivateKey: key}))
+	if err != nil {
+		t.Errorf("certificate and key mismatch: %v", err)
+	}
+}
+
+func encodePEMPair(t *testing.T, c *tls.Certificate) ([]byte, []byte) {
+	certPEM, keyPEM, err := EncodePEM(c)
+	if err != nil {
+		t.Fatalf("EncodePEM() error %v", err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestSignCSRPolicy(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	policy := &SigningPolicy{
+		AllowedDNSNames: []string{"*.example.com"},
+	}
+
+	for _, opts := range []Options{
+		{DNSNames: []string{"example.com"}},
+		{DNSNames: []string{"foo.example.org"}},
+		{DNSNames: []string{"foo.example.com", "evil.com"}},
+		{IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}},
+		{EmailAddresses: []string{"admin@example.com"}},
+		{CommonName: "anything.evil"},
+		{CommonName: "10.1.2.3", DNSNames: []string{"foo.example.com"}},
+		{DNSNames: []string{"*.example.com"}},
+		{DNSNames: []string{"*.svc.example.com"}},
+		{CommonName: "*.svc.example.com"},
+	} {
+		csr, _, err := NewCSR(opts)
+		if err != nil {
+			t.Fatalf("NewCSR() error %v", err)
+		}
+		_, err = ca.SignCSR(csr, 0, policy)
+		if !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("SignCSR(%v) error %v, expected ErrPolicyViolation", opts, err)
+		}
+	}
+
+	csr, _, err := NewCSR(Options{DNSNames: []string{"foo.example.com"}})
+	if err != nil {
+		t.Fatalf("NewCSR() error %v", err)
+	}
+	if _, err := ca.SignCSR(csr, 0, policy); err != nil {
+		t.Errorf("SignCSR() error %v", err)
+	}
+	if _, err := ca.SignCSR(csr, -time.Hour, policy); err != ErrNegativeValidity {
+		t.Errorf("SignCSR(-1h) error %v != ErrNegativeValidity", err)
+	}
+
+	// Corrupt the signature.
+	csr[len(csr)-1] ^= 0xff
+	if _, err := ca.SignCSR(csr, 0, policy); err == nil {
+		t.Error("expected error for corrupt CSR")
+	}
+
+	// Wildcards are only allowed if the policy opts in.
+	csr, _, err = NewCSR(Options{DNSNames: []string{"*.svc.example.com"}})
+	if err != nil {
+		t.Fatalf("NewCSR() error %v", err)
+	}
+	wildcardPolicy := &SigningPolicy{AllowedDNSNames: policy.AllowedDNSNames, AllowWildcards: true}
+	if _, err := ca.SignCSR(csr, 0, wildcardPolicy); err != nil {
+		t.Errorf("SignCSR(wildcard) error %v", err)
+	}
+	for _, name := range []string{"*.org", "foo.*.example.com", "f*.example.com", "*.*.example.com"} {
+		csr, _, err := NewCSR(Options{DNSNames: []string{name}})
+		if err != nil {
+			t.Fatalf("NewCSR() error %v", err)
+		}
+		if _, err := ca.SignCSR(csr, 0, wildcardPolicy); !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("SignCSR(%s) error %v, expected ErrPolicyViolation", name, err)
+		}
+	}
+}
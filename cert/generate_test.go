@@ -0,0 +1,50 @@
+package cert
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestGenerateEd25519(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error %v", err)
+	}
+	der, key := GenerateCert(Options{PrivateKey: priv})
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error %v", err)
+	}
+	if parsed.PublicKeyAlgorithm != x509.Ed25519 {
+		t.Errorf("PublicKeyAlgorithm %v != Ed25519", parsed.PublicKeyAlgorithm)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Errorf("unexpected private key type %T", key)
+	}
+}
+
+func TestGenerateUnsupportedKey(t *testing.T) {
+	for _, key := range []interface{}{"not a key", ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))} {
+		c, err := Generate(Options{PrivateKey: key})
+		if !errors.Is(err, ErrUnsupportedKeyType) {
+			t.Errorf("Generate(%T) error %v != ErrUnsupportedKeyType", key, err)
+		}
+		if c != nil {
+			t.Errorf("Generate(%T) returned certificate on error", key)
+		}
+	}
+}
+
+func TestGenerateCertPanics(t *testing.T) {
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || !errors.Is(err, ErrUnsupportedKeyType) {
+			t.Errorf("GenerateCert() panic %v, want ErrUnsupportedKeyType", r)
+		}
+	}()
+	GenerateCert(Options{PrivateKey: "not a key"})
+	t.Error("GenerateCert() did not panic")
+}
@@ -0,0 +1,140 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CertFileName = "cert.pem"
+	KeyFileName  = "key.pem"
+
+	// LoadOrGenerate regenerates a certificate when less than
+	// 1/RenewalFraction of its validity period remains.
+	RenewalFraction = 4
+)
+
+// EncodePEM encodes the certificate chain of cert, and its private key in
+// PKCS #8 form, as PEM.
+func EncodePEM(cert *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	if len(cert.Certificate) == 0 {
+		return nil, nil, errors.New("cert: empty certificate")
+	}
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		err = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert: failed to marshal private key: %w", err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return buf.Bytes(), keyPEM, nil
+}
+
+// DecodePEM decodes a PEM encoded certificate chain and private key. The
+// returned certificate has Leaf populated.
+func DecodePEM(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("cert: failed to decode PEM: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("cert: failed to parse certificate: %w", err)
+		}
+	}
+	return &cert, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// SaveToDir writes the PEM encoded certificate and private key into dir, as
+// CertFileName and KeyFileName. The private key is only readable by the
+// current user.
+func SaveToDir(dir string, cert *tls.Certificate) error {
+	certPEM, keyPEM, err := EncodePEM(cert)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(dir, KeyFileName), keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, CertFileName), certPEM, 0644)
+}
+
+// LoadFromDir loads a certificate and private key saved by SaveToDir.
+func LoadFromDir(dir string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, CertFileName))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, KeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	return DecodePEM(certPEM, keyPEM)
+}
+
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	window := cert.NotAfter.Sub(cert.NotBefore) / RenewalFraction
+	return now.Add(window).After(cert.NotAfter)
+}
+
+// LoadOrGenerate loads a certificate from dir. If the certificate does not
+// exist, can't be decoded, or has less than 1/RenewalFraction of its validity
+// period remaining, a new certificate is generated using opts, and saved into
+// dir. Since SaveToDir writes the key and certificate separately, a crash may
+// leave a mismatched pair, which is repaired by regenerating. Errors reading
+// the files, other than the files not existing, are returned.
+func LoadOrGenerate(dir string, opts Options) (*tls.Certificate, error) {
+	cert, err := LoadFromDir(dir)
+	var pathErr *os.PathError
+	if err == nil && !needsRenewal(cert.Leaf, time.Now()) {
+		return cert, nil
+	} else if err != nil && !os.IsNotExist(err) && errors.As(err, &pathErr) {
+		return nil, err
+	}
+
+	cert, err = Generate(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = SaveToDir(dir, cert)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
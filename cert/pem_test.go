@@ -0,0 +1,160 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPEMRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error %v", err)
+	}
+
+	for _, key := range []interface{}{nil, rsaKey, edKey} {
+		c, err := Generate(Options{PrivateKey: key})
+		if err != nil {
+			t.Fatalf("Generate() error %v", err)
+		}
+		certPEM, keyPEM, err := EncodePEM(c)
+		if err != nil {
+			t.Fatalf("EncodePEM() error %v", err)
+		}
+		decoded, err := DecodePEM(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("DecodePEM() error %v", err)
+		}
+		if !bytes.Equal(decoded.Certificate[0], c.Certificate[0]) {
+			t.Errorf("decoded certificate mismatch")
+		}
+		if decoded.Leaf == nil || decoded.Leaf.SerialNumber.Cmp(c.Leaf.SerialNumber) != 0 {
+			t.Errorf("decoded leaf mismatch")
+		}
+	}
+}
+
+func TestSaveLoadDir(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	c, err := ca.IssueServer(Options{}, "example.com")
+	if err != nil {
+		t.Fatalf("IssueServer() error %v", err)
+	}
+	if err := SaveToDir(dir, c); err != nil {
+		t.Fatalf("SaveToDir() error %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, KeyFileName))
+	if err != nil {
+		t.Fatalf("Stat() error %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v != 0600", fi.Mode().Perm())
+	}
+
+	loaded, err := LoadFromDir(dir)
+	if err != nil {
+		t.Fatalf("LoadFromDir() error %v", err)
+	}
+	if len(loaded.Certificate) != 2 {
+		t.Errorf("loaded chain length %d != 2", len(loaded.Certificate))
+	}
+	if err := loaded.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Errorf("VerifyHostname() error %v", err)
+	}
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	dir := t.TempDir()
+
+	c1, err := LoadOrGenerate(dir, Options{})
+	if err != nil {
+		t.Fatalf("LoadOrGenerate() error %v", err)
+	}
+	c2, err := LoadOrGenerate(dir, Options{})
+	if err != nil {
+		t.Fatalf("LoadOrGenerate() error %v", err)
+	}
+	if !bytes.Equal(c1.Certificate[0], c2.Certificate[0]) {
+		t.Error("certificate regenerated, expected reuse")
+	}
+
+	// Within the renewal window.
+	nearExpiry, err := Generate(Options{
+		NotBefore: time.Now().Add(-time.Hour),
+		Expiry:    time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+	if err := SaveToDir(dir, nearExpiry); err != nil {
+		t.Fatalf("SaveToDir() error %v", err)
+	}
+	c3, err := LoadOrGenerate(dir, Options{})
+	if err != nil {
+		t.Fatalf("LoadOrGenerate() error %v", err)
+	}
+	if bytes.Equal(c3.Certificate[0], nearExpiry.Certificate[0]) {
+		t.Error("expected certificate to be regenerated")
+	}
+	c4, err := LoadFromDir(dir)
+	if err != nil {
+		t.Fatalf("LoadFromDir() error %v", err)
+	}
+	if !bytes.Equal(c3.Certificate[0], c4.Certificate[0]) {
+		t.Error("regenerated certificate not saved")
+	}
+
+	// A corrupt certificate, or a key which doesn't match the certificate (as
+	// left by a crash during SaveToDir), is replaced.
+	other, err := Generate(Options{})
+	if err != nil {
+		t.Fatalf("Generate() error %v", err)
+	}
+	_, otherKeyPEM, err := EncodePEM(other)
+	if err != nil {
+		t.Fatalf("EncodePEM() error %v", err)
+	}
+	for name, data := range map[string][]byte{
+		CertFileName: []byte("garbage"),
+		KeyFileName:  otherKeyPEM,
+	} {
+		if err := SaveToDir(dir, c3); err != nil {
+			t.Fatalf("SaveToDir() error %v", err)
+		}
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+		c5, err := LoadOrGenerate(dir, Options{})
+		if err != nil {
+			t.Fatalf("LoadOrGenerate() error %v with corrupt %s", err, name)
+		}
+		if bytes.Equal(c5.Certificate[0], c3.Certificate[0]) {
+			t.Errorf("expected certificate to be regenerated with corrupt %s", name)
+		}
+		if _, err := LoadFromDir(dir); err != nil {
+			t.Errorf("LoadFromDir() error %v after repairing %s", err, name)
+		}
+	}
+
+	// Errors reading the files are returned, rather than overwriting them.
+	keyPath := filepath.Join(dir, KeyFileName)
+	os.Remove(keyPath)
+	os.Mkdir(keyPath, 0700)
+	var pathErr *os.PathError
+	if _, err := LoadOrGenerate(dir, Options{}); !errors.As(err, &pathErr) {
+		t.Errorf("LoadOrGenerate() error %v, expected read error", err)
+	}
+}
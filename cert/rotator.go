@@ -0,0 +1,170 @@
+package cert
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRotationCheckInterval = time.Minute
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type defaultClock struct{}
+
+func (defaultClock) Now() time.Time {
+	return time.Now()
+}
+
+// GenerateFunc generates a new certificate. For example, a closure calling
+// Generate, or CA.IssueServer. The generated certificate MUST have Leaf
+// populated.
+type GenerateFunc func() (*tls.Certificate, error)
+
+type RotatorOptions struct {
+	// Time before expiry at which the certificate is rotated. If zero,
+	// rotation happens when less than 1/RenewalFraction of the certificate's
+	// validity period remains.
+	RenewBefore time.Duration
+
+	// Interval between background checks for rotation. If zero,
+	// DefaultRotationCheckInterval is used.
+	CheckInterval time.Duration
+
+	// If nil, the system clock is used.
+	Clock Clock
+}
+
+// Rotator holds a certificate, and replaces it with a newly generated one
+// before it expires. Rotator can be plugged into tls.Config using the
+// GetCertificate and GetClientCertificate methods.
+type Rotator struct {
+	gen         GenerateFunc
+	renewBefore time.Duration
+	clock       Clock
+
+	cert *tls.Certificate
+	lock sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRotator generates an initial certificate using gen, and starts a
+// background goroutine to rotate it. Close must be called to stop the
+// goroutine. opts may be nil.
+func NewRotator(gen GenerateFunc, opts *RotatorOptions) (*Rotator, error) {
+	if opts == nil {
+		opts = &RotatorOptions{}
+	}
+	r := &Rotator{
+		gen:         gen,
+		renewBefore: opts.RenewBefore,
+		clock:       opts.Clock,
+		stop:        make(chan struct{}),
+	}
+	if r.clock == nil {
+		r.clock = defaultClock{}
+	}
+	checkInterval := opts.CheckInterval
+	if checkInterval == 0 {
+		checkInterval = DefaultRotationCheckInterval
+	}
+
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	go r.rotateLoop(checkInterval)
+	return r, nil
+}
+
+func (r *Rotator) rotateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.maybeRotate()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Rotator) needsRotation() bool {
+	leaf := r.cert.Leaf
+	if r.renewBefore == 0 {
+		return needsRenewal(leaf, r.clock.Now())
+	}
+	return r.clock.Now().Add(r.renewBefore).After(leaf.NotAfter)
+}
+
+func (r *Rotator) generate() (*tls.Certificate, error) {
+	cert, err := r.gen()
+	if err != nil {
+		return nil, err
+	} else if cert.Leaf == nil {
+		return nil, errors.New("cert: generated certificate missing Leaf")
+	}
+	return cert, nil
+}
+
+func (r *Rotator) maybeRotate() {
+	r.lock.Lock()
+	rotate := r.needsRotation()
+	r.lock.Unlock()
+	if !rotate {
+		return
+	}
+
+	err := r.Rotate()
+	if err != nil {
+		// Keep the existing certificate, and retry on the next check.
+		log.Println("Error rotating certificate:", err)
+	}
+}
+
+// Rotate immediately replaces the current certificate with a newly generated
+// one.
+func (r *Rotator) Rotate() error {
+	cert, err := r.generate()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.cert = cert
+	r.lock.Unlock()
+	return nil
+}
+
+// Certificate returns the current certificate.
+func (r *Rotator) Certificate() *tls.Certificate {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Rotator) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *Rotator) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Close stops background rotation.
+func (r *Rotator) Close() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	return nil
+}
@@ -0,0 +1,109 @@
+package cert
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRotator(t *testing.T) {
+	const validity = 24 * time.Hour
+
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	clock := &fakeClock{now: time.Now()}
+	gen := func() (*tls.Certificate, error) {
+		now := clock.Now()
+		return ca.IssueServer(Options{
+			NotBefore: now,
+			Expiry:    now.Add(validity),
+		}, "example.com")
+	}
+
+	r, err := NewRotator(gen, &RotatorOptions{
+		RenewBefore:   time.Hour,
+		CheckInterval: time.Millisecond,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatalf("NewRotator() error %v", err)
+	}
+	defer r.Close()
+
+	c1, err := r.GetCertificate(nil)
+	if err != nil || c1 == nil {
+		t.Fatalf("GetCertificate() = %v, %v", c1, err)
+	}
+
+	clock.Advance(validity - 2*time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if r.Certificate() != c1 {
+		t.Error("certificate rotated before renewal window")
+	}
+
+	clock.Advance(90 * time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Certificate() == c1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c2, err := r.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetClientCertificate() error %v", err)
+	}
+	if c2 == c1 {
+		t.Fatal("certificate not rotated")
+	}
+	if !c2.Leaf.NotAfter.After(c1.Leaf.NotAfter) {
+		t.Errorf("rotated certificate expiry %v not after %v", c2.Leaf.NotAfter, c1.Leaf.NotAfter)
+	}
+
+	if err := r.Rotate(); err != nil {
+		t.Errorf("Rotate() error %v", err)
+	}
+	if r.Certificate() == c2 {
+		t.Error("certificate not rotated by Rotate()")
+	}
+}
+
+func TestRotatorTLS(t *testing.T) {
+	ca, err := NewCA(Options{})
+	if err != nil {
+		t.Fatalf("NewCA() error %v", err)
+	}
+	r, err := NewRotator(func() (*tls.Certificate, error) {
+		return ca.IssueServer(Options{}, "example.com")
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewRotator() error %v", err)
+	}
+	defer r.Close()
+
+	config := &tls.Config{GetCertificate: r.GetCertificate}
+	c, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate() error %v", err)
+	}
+	if err := c.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Errorf("VerifyHostname() error %v", err)
+	}
+}
@@ -4,78 +4,348 @@ package compressedbuffer
 
 import (
 	"bytes"
-	"compress/zlib"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+
+	"github.com/akmistry/go-util/tempfile"
 )
 
 const (
-	BlockSize = 4096
+	DefaultBlockSize = 4096
+
+	// Maximum number of blocks waiting for background compression, per worker.
+	// Beyond this, blocks are compressed synchronously by Write.
+	pendingBlocksPerWorker = 4
+
+	// Deprecated: Use DefaultBlockSize, or Options.BlockSize.
+	BlockSize = DefaultBlockSize
 )
 
 var (
-	zWriterPool = sync.Pool{}
-	zReaderPool = sync.Pool{}
-	compBufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	ErrNegativeOffset = errors.New("compressedbuffer: negative offset")
+	ErrNegativeSize   = errors.New("compressedbuffer: negative size")
+
+	errChecksum     = errors.New("checksum mismatch")
+	errFileChecksum = errors.New("temporary file checksum mismatch")
+
+	compBufPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+	// Read-only []byte of zeros, grown as needed by zeroBytes.
+	zeros atomic.Value
 )
 
+// ErrCorrupt is returned when a block fails its checksum, or can't be
+// decompressed.
+type ErrCorrupt struct {
+	// Index of the corrupt block.
+	Block int
+	// Cause of the corruption, such as a decompression error.
+	Err error
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("compressedbuffer: corrupt block %d: %v", e.Block, e.Err)
+}
+
+func (e *ErrCorrupt) Unwrap() error {
+	return e.Err
+}
+
+// zeroBytes returns a read-only slice of n zeros.
+func zeroBytes(n int) []byte {
+	z, _ := zeros.Load().([]byte)
+	if len(z) < n {
+		z = make([]byte, n)
+		zeros.Store(z)
+	}
+	return z[:n]
+}
+
+type Options struct {
+	// Codec used to compress blocks. If nil, DefaultCodec is used.
+	Codec Codec
+
+	// Size of each compressed block. Larger blocks generally compress better,
+	// at the cost of more data being decompressed for small reads. If zero,
+	// DefaultBlockSize is used.
+	BlockSize int
+
+	// Number of decompressed blocks to cache. If zero, DefaultCacheBlocks is
+	// used. If negative, decompressed blocks are not cached.
+	CacheBlocks int
+
+	// Number of goroutines used to compress completed blocks in the background.
+	// Until compressed, blocks are stored (and read) uncompressed. If zero,
+	// blocks are compressed synchronously by Write.
+	CompressionWorkers int
+
+	// Maximum size of compressed blocks held in memory. Once exceeded, the
+	// oldest blocks are moved to a temporary file, and read back on demand.
+	// If zero, all blocks are held in memory. Close MUST be called to remove
+	// the temporary file.
+	MemoryLimit int64
+
+	// Directory in which the temporary file is created. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+}
+
+type block struct {
+	// If nil, and fileLen is 0, the block is all zeros, and isn't stored.
+	data []byte
+	// If non-zero, the block is stored in the temporary file, at fileOff.
+	fileOff int64
+	fileLen int
+	// CRC-32C of the data stored in the temporary file.
+	fileCRC uint32
+	// CRC-32C of the uncompressed block.
+	crc uint32
+	// If true, data is stored uncompressed because compression did not reduce
+	// its size, or because it is waiting for background compression.
+	raw bool
+	// If true, the block is waiting for background compression.
+	pending bool
+	// Identifies the block in the decompressed block cache.
+	id cacheKey
+}
+
+// blockRead is a read of a single block, done outside the buffer lock.
+type blockRead struct {
+	index int
+	blk   block
+	off   int
+	dst   []byte
+	start int
+}
+
+func (blk *block) isZero() bool {
+	return blk.data == nil && blk.fileLen == 0
+}
+
+func (blk *block) storedLen() int {
+	if blk.fileLen > 0 {
+		return blk.fileLen
+	}
+	return len(blk.data)
+}
+
+type compressJob struct {
+	index int
+	data  []byte
+}
+
+func isZero(p []byte) bool {
+	return bytes.Equal(p, zeroBytes(len(p)))
+}
+
 // A Buffer is a variable-sized buffer, with Write and ReadAt methods (Read can
 // be done using io.SectionReader). The zero value for Buffer is an empty
 // buffer ready to use. Buffer contains internal synchronisation, allowing for
-// concurrent use.
+// concurrent use. Concurrent calls to ReadAt do not block each other, and
+// decompression is done without holding the buffer lock.
 type Buffer struct {
-	blocks         [][]byte
+	codec     Codec
+	blockSize int
+
+	blocks         []block
 	size           int64
 	compressedSize int64
 
 	writeBuf bytes.Buffer
 
-	lastDecompIndex int
-	lastDecompBlock []byte
+	decomp decompressor
+	nextID cacheKey
+
+	// Background compression state.
+	maxWorkers    int
+	activeWorkers int
+	queue         []compressJob
+	pendingBlocks int
+	compressErr   error
+
+	// Spill state. spillFile is never modified once created, so that it may be
+	// used without holding lock.
+	memoryLimit int64
+	memorySize  int64
+	tempDir     string
+	spillFile   tempfile.File
+	spillEnd    int64
+	spillNext   int
 
-	lock sync.Mutex
+	lock sync.RWMutex
+	cond *sync.Cond
 }
 
-func (b *Buffer) appendBlock(p []byte) error {
-	if len(p) != BlockSize {
-		log.Panicf("Invalid flush size %d", len(p))
-	}
-	compBuf := compBufPool.Get().(*bytes.Buffer)
-	var zw *zlib.Writer
-	if zwi := zWriterPool.Get(); zwi != nil {
-		zw = zwi.(*zlib.Writer)
-		zw.Reset(compBuf)
-	} else {
-		var err error
-		zw, err = zlib.NewWriterLevel(compBuf, zlib.BestSpeed)
-		if err != nil {
-			panic(err)
+// NewBuffer returns an empty Buffer using opts. opts may be nil.
+func NewBuffer(opts *Options) *Buffer {
+	b := &Buffer{}
+	b.cond = sync.NewCond(&b.lock)
+	if opts != nil {
+		if opts.BlockSize < 0 {
+			panic("compressedbuffer: negative BlockSize")
 		}
+		b.codec = opts.Codec
+		b.blockSize = opts.BlockSize
+		b.decomp.cache.capacity = opts.CacheBlocks
+		b.maxWorkers = opts.CompressionWorkers
+		b.memoryLimit = opts.MemoryLimit
+		b.tempDir = opts.TempDir
 	}
-	defer zWriterPool.Put(zw)
-	n, err := zw.Write(p)
-	if err != nil {
-		return err
-	} else if n != BlockSize {
-		log.Panicf("Zlib written %d != buffer size %d", n, BlockSize)
+	return b
+}
+
+func (b *Buffer) getBlockSize() int {
+	if b.blockSize == 0 {
+		return DefaultBlockSize
+	}
+	return b.blockSize
+}
+
+func (b *Buffer) getCodec() Codec {
+	if b.codec == nil {
+		return DefaultCodec
 	}
-	err = zw.Close()
+	return b.codec
+}
+
+// compressBlock compresses p, falling back to storing p uncompressed if
+// compression does not reduce its size.
+func compressBlock(codec Codec, p []byte) (block, error) {
+	compBuf := compBufPool.Get().(*[]byte)
+	defer compBufPool.Put(compBuf)
+
+	var err error
+	*compBuf, err = codec.Compress((*compBuf)[:0], p)
 	if err != nil {
-		return err
+		return block{}, err
 	}
-	b.compressedSize += int64(compBuf.Len())
-	block := make([]byte, compBuf.Len())
-	_, err = compBuf.Read(block)
+	if len(*compBuf) >= len(p) {
+		return block{data: append([]byte(nil), p...), raw: true}, nil
+	}
+	return block{data: append([]byte(nil), *compBuf...)}, nil
+}
+
+func (b *Buffer) makeBlock(p []byte) (block, error) {
+	if len(p) != b.getBlockSize() {
+		log.Panicf("Invalid flush size %d", len(p))
+	}
+	if isZero(p) {
+		return block{}, nil
+	}
+	blk, err := compressBlock(b.getCodec(), p)
+	blk.id = b.newID()
+	blk.crc = crc32.Checksum(p, crcTable)
+	return blk, err
+}
+
+func (b *Buffer) newID() cacheKey {
+	b.nextID++
+	return b.nextID
+}
+
+// appendBlock appends p as a new block. If background compression is enabled,
+// and the compression queue isn't full, p is queued for compression.
+// Otherwise, p is compressed synchronously, so that a single large write
+// can't queue an unbounded number of uncompressed blocks.
+func (b *Buffer) appendBlock(p []byte) error {
+	if b.maxWorkers > 0 && b.pendingBlocks < b.maxWorkers*pendingBlocksPerWorker && !isZero(p) {
+		b.appendPending(p)
+		return nil
+	}
+	blk, err := b.makeBlock(p)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	b.blocks = append(b.blocks, block)
-	compBuf.Reset()
-	compBufPool.Put(compBuf)
+	b.account(blk, 1)
+	b.blocks = append(b.blocks, blk)
 	return nil
 }
 
+// appendPending appends an uncompressed copy of p as a new block, and queues
+// it for background compression.
+func (b *Buffer) appendPending(p []byte) {
+	data := append([]byte(nil), p...)
+	b.queue = append(b.queue, compressJob{index: len(b.blocks), data: data})
+	b.pendingBlocks++
+	blk := block{data: data, raw: true, pending: true, crc: crc32.Checksum(data, crcTable)}
+	b.account(blk, 1)
+	b.blocks = append(b.blocks, blk)
+
+	if b.activeWorkers < b.maxWorkers {
+		b.activeWorkers++
+		go b.compressWorker()
+	}
+}
+
+func (b *Buffer) compressWorker() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	codec := b.getCodec()
+	for len(b.queue) > 0 {
+		job := b.queue[0]
+		b.queue[0] = compressJob{}
+		b.queue = b.queue[1:]
+
+		b.lock.Unlock()
+		blk, err := compressBlock(codec, job.data)
+		b.lock.Lock()
+
+		b.pendingBlocks--
+		b.cond.Broadcast()
+
+		// The block may have been overwritten or truncated while being
+		// compressed, in which case the result is stale.
+		i := job.index
+		if i >= len(b.blocks) || !b.blocks[i].pending || &b.blocks[i].data[0] != &job.data[0] {
+			continue
+		}
+		if err != nil {
+			// The uncompressed block is still valid, so keep it as a plain raw
+			// block, and report the error from Flush.
+			b.blocks[i].pending = false
+			if b.compressErr == nil {
+				b.compressErr = err
+			}
+		} else if blk.raw {
+			b.blocks[i].pending = false
+		} else {
+			blk.id = b.newID()
+			blk.crc = b.blocks[i].crc
+			b.account(b.blocks[i], -1)
+			b.account(blk, 1)
+			b.blocks[i] = blk
+		}
+		if i < b.spillNext {
+			b.spillNext = i
+		}
+		if err := b.maybeSpill(); err != nil && b.compressErr == nil {
+			b.compressErr = err
+		}
+	}
+	b.activeWorkers--
+}
+
+// Flush waits for all completed blocks to be compressed, and returns any
+// error from background compression. The final, partial, block is not
+// compressed. Flush is only necessary if Options.CompressionWorkers is
+// non-zero.
+func (b *Buffer) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.pendingBlocks > 0 {
+		b.cond.Wait()
+	}
+	err := b.compressErr
+	b.compressErr = nil
+	return err
+}
+
 func (b *Buffer) flushWriter() error {
 	err := b.appendBlock(b.writeBuf.Bytes())
 	if err != nil {
@@ -85,19 +355,37 @@ func (b *Buffer) flushWriter() error {
 	return nil
 }
 
+// waitPending waits until the number of blocks waiting for background
+// compression is under the limit, to bound memory used by uncompressed blocks
+// if compression can't keep up. b.lock MUST be held.
+func (b *Buffer) waitPending() {
+	for b.maxWorkers > 0 && b.pendingBlocks >= b.maxWorkers*pendingBlocksPerWorker {
+		b.cond.Wait()
+	}
+}
+
 func (b *Buffer) Write(p []byte) (int, error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	b.waitPending()
+	n, err := b.appendData(p)
+	if err == nil {
+		err = b.maybeSpill()
+	}
+	return n, err
+}
 
+func (b *Buffer) appendData(p []byte) (int, error) {
+	blockSize := b.getBlockSize()
 	written := 0
 	var err error
 	for len(p) > 0 {
-		rem := BlockSize - b.writeBuf.Len()
+		rem := blockSize - b.writeBuf.Len()
 		writeLen := len(p)
 		if writeLen > rem {
 			writeLen = rem
 		}
-		if writeLen == BlockSize {
+		if writeLen == blockSize {
 			// Skip staging in writeBuf if a complete block is being written.
 			err = b.appendBlock(p[:writeLen])
 		} else {
@@ -109,7 +397,7 @@ func (b *Buffer) Write(p []byte) (int, error) {
 		written += writeLen
 		b.size += int64(writeLen)
 		p = p[writeLen:]
-		if b.writeBuf.Len() == BlockSize {
+		if b.writeBuf.Len() == blockSize {
 			err = b.flushWriter()
 			if err != nil {
 				break
@@ -119,75 +407,244 @@ func (b *Buffer) Write(p []byte) (int, error) {
 	return written, err
 }
 
-func (b *Buffer) Size() int64 {
+// extendTo extends the buffer with zeros to size. Whole zero blocks are not
+// stored.
+func (b *Buffer) extendTo(size int64) error {
+	blockSize := b.getBlockSize()
+	for b.size < size {
+		if b.writeBuf.Len() == 0 && size-b.size >= int64(blockSize) {
+			b.blocks = append(b.blocks, block{})
+			b.size += int64(blockSize)
+			continue
+		}
+		padLen := blockSize - b.writeBuf.Len()
+		if int64(padLen) > size-b.size {
+			padLen = int(size - b.size)
+		}
+		_, err := b.appendData(zeroBytes(padLen))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchBlock replaces the data in block i at offset off with p, and
+// recompresses the block.
+func (b *Buffer) patchBlock(i, off int, p []byte) error {
+	buf := make([]byte, b.getBlockSize())
+	err := b.readBlockInto(i, b.blocks[i], buf, 0)
+	if err != nil {
+		return err
+	}
+	copy(buf[off:], p)
+
+	blk, err := b.makeBlock(buf)
+	if err != nil {
+		return err
+	}
+	b.uncache(b.blocks[i])
+	b.account(b.blocks[i], -1)
+	b.account(blk, 1)
+	b.blocks[i] = blk
+	if i < b.spillNext {
+		b.spillNext = i
+	}
+	return nil
+}
+
+// WriteAt writes p at offset off. Writing past the end of the buffer extends
+// it, with any gap filled with zeros.
+func (b *Buffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	return b.size
+	b.waitPending()
+
+	if off > b.size {
+		err := b.extendTo(off)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	blockSize := int64(b.getBlockSize())
+	written := 0
+	for len(p) > 0 && off < b.size {
+		i := int(off / blockSize)
+		blockOff := int(off % blockSize)
+
+		var n int
+		if i == len(b.blocks) {
+			n = copy(b.writeBuf.Bytes()[blockOff:], p)
+		} else {
+			n = int(blockSize) - blockOff
+			if n > len(p) {
+				n = len(p)
+			}
+			err := b.patchBlock(i, blockOff, p[:n])
+			if err != nil {
+				return written, err
+			}
+		}
+		written += n
+		p = p[n:]
+		off += int64(n)
+	}
+
+	n, err := b.appendData(p)
+	if err == nil {
+		err = b.maybeSpill()
+	}
+	return written + n, err
 }
 
-func (b *Buffer) CompressedSize() int64 {
+// Truncate changes the size of the buffer. If size is larger than the current
+// size, the buffer is extended with zeros.
+func (b *Buffer) Truncate(size int64) error {
+	if size < 0 {
+		return ErrNegativeSize
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	return b.compressedSize + int64(b.writeBuf.Len())
-}
+	b.waitPending()
 
-func (b *Buffer) readBlock(i int) ([]byte, error) {
-	if b.lastDecompBlock != nil && b.lastDecompIndex == i {
-		return b.lastDecompBlock, nil
+	if size >= b.size {
+		err := b.extendTo(size)
+		if err == nil {
+			err = b.maybeSpill()
+		}
+		return err
 	}
 
-	var err error
-	var zr io.ReadCloser
-	if zri := zReaderPool.Get(); zri != nil {
-		zr = zri.(io.ReadCloser)
-		err = zr.(zlib.Resetter).Reset(bytes.NewReader(b.blocks[i]), nil)
+	blockSize := int64(b.getBlockSize())
+	numBlocks := int(size / blockSize)
+	tailLen := int(size % blockSize)
+	if numBlocks < len(b.blocks) {
+		tail := make([]byte, tailLen)
+		if tailLen > 0 {
+			err := b.readBlockInto(numBlocks, b.blocks[numBlocks], tail, 0)
+			if err != nil {
+				return err
+			}
+		}
+		for i := numBlocks; i < len(b.blocks); i++ {
+			b.uncache(b.blocks[i])
+			b.account(b.blocks[i], -1)
+			b.blocks[i] = block{}
+		}
+		b.blocks = b.blocks[:numBlocks]
+		if numBlocks < b.spillNext {
+			b.spillNext = numBlocks
+		}
+		b.writeBuf.Reset()
+		b.writeBuf.Write(tail)
 	} else {
-		zr, err = zlib.NewReader(bytes.NewReader(b.blocks[i]))
+		b.writeBuf.Truncate(tailLen)
 	}
-	if err != nil {
-		return nil, err
+	b.size = size
+	return nil
+}
+
+func (b *Buffer) Size() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.size
+}
+
+func (b *Buffer) CompressedSize() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.compressedSize + int64(b.writeBuf.Len())
+}
+
+// CacheStats returns the hit and miss counts of the decompressed block cache.
+func (b *Buffer) CacheStats() CacheStats {
+	return b.decomp.stats()
+}
+
+// uncache removes blk from the decompressed block cache.
+func (b *Buffer) uncache(blk block) {
+	if !blk.isZero() && !blk.raw {
+		b.decomp.remove(blk.id)
 	}
-	defer zReaderPool.Put(zr)
-	defer zr.Close()
+}
 
-	buf := make([]byte, BlockSize)
-	_, err = io.ReadFull(zr, buf)
-	if err != nil {
-		return nil, err
+// readBlockInto copies the uncompressed contents of blk, block i, starting at
+// off, into dst. The block checksum is verified. Block data is immutable, so
+// the buffer lock does not need to be held.
+func (b *Buffer) readBlockInto(i int, blk block, dst []byte, off int) error {
+	if blk.isZero() {
+		copy(dst, zeroBytes(len(dst)))
+		return nil
+	} else if blk.raw {
+		data, err := b.storedData(i, blk)
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(data, crcTable) != blk.crc {
+			return &ErrCorrupt{Block: i, Err: errChecksum}
+		}
+		copy(dst, data[off:])
+		return nil
 	}
-	b.lastDecompBlock = buf
-	b.lastDecompIndex = i
-	return buf, nil
+	return b.decomp.read(b.getCodec(), b.getBlockSize(), i, blk.id, blk.crc, dst, off, func() ([]byte, error) {
+		return b.storedData(i, blk)
+	})
 }
 
 func (b *Buffer) ReadAt(p []byte, off int64) (int, error) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
 
+	var readsArray [4]blockRead
+	reads := readsArray[:0]
+
+	b.lock.RLock()
+	blockSize := int64(b.getBlockSize())
 	bytesRead := 0
 	var err error
 	for len(p) > 0 {
 		if off >= b.size {
-			return bytesRead, io.EOF
+			err = io.EOF
+			break
 		}
-		block := int(off / BlockSize)
-		blockOff := int(off % BlockSize)
+		block := int(off / blockSize)
+		blockOff := int(off % blockSize)
 
-		var blockBuf []byte
+		var n int
 		if block == len(b.blocks) {
 			// Block is currently being written, so use writeBuf as the source
-			blockBuf = b.writeBuf.Bytes()
+			n = copy(p, b.writeBuf.Bytes()[blockOff:])
 		} else {
-			blockBuf, err = b.readBlock(block)
-			if err != nil {
-				break
+			n = int(blockSize) - blockOff
+			if n > len(p) {
+				n = len(p)
 			}
+			reads = append(reads, blockRead{
+				index: block,
+				blk:   b.blocks[block],
+				off:   blockOff,
+				dst:   p[:n],
+				start: bytesRead,
+			})
 		}
-
-		n := copy(p, blockBuf[blockOff:])
 		bytesRead += n
 		p = p[n:]
 		off += int64(n)
 	}
+	b.lock.RUnlock()
+
+	for _, r := range reads {
+		rerr := b.readBlockInto(r.index, r.blk, r.dst, r.off)
+		if rerr != nil {
+			return r.start, rerr
+		}
+	}
 	return bytesRead, err
 }
@@ -2,6 +2,7 @@ package compressedbuffer
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math/rand"
 	"testing"
@@ -125,3 +126,205 @@ func TestBufferStress(t *testing.T) {
 		t.Error("Bytes read != written")
 	}
 }
+
+func TestBufferWriteAtStress(t *testing.T) {
+	testWriteAtStress(t, &Buffer{})
+}
+
+func TestBufferWriteAtStressWorkers(t *testing.T) {
+	b := NewBuffer(&Options{CompressionWorkers: 4})
+	testWriteAtStress(t, b)
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush() error %v", err)
+	}
+}
+
+func testWriteAtStress(t *testing.T, b *Buffer) {
+	const Iterations = 2000
+	const MaxSize = 64 * BlockSize
+	const MaxOpSize = 3 * BlockSize
+
+	rand.Seed(4)
+	var expected []byte
+
+	for i := 0; i < Iterations; i++ {
+		switch rand.Intn(4) {
+		case 0, 1:
+			writeBuf := make([]byte, rand.Intn(MaxOpSize))
+			if rand.Intn(2) == 0 {
+				rand.Read(writeBuf)
+			}
+			off := rand.Intn(MaxSize)
+			n, err := b.WriteAt(writeBuf, int64(off))
+			if err != nil || n != len(writeBuf) {
+				t.Fatalf("WriteAt() = %d, %v", n, err)
+			}
+			if end := off + len(writeBuf); end > len(expected) {
+				expected = append(expected, make([]byte, end-len(expected))...)
+			}
+			copy(expected[off:], writeBuf)
+		case 2:
+			size := rand.Intn(MaxSize)
+			if err := b.Truncate(int64(size)); err != nil {
+				t.Fatalf("Truncate(%d) error %v", size, err)
+			}
+			if size > len(expected) {
+				expected = append(expected, make([]byte, size-len(expected))...)
+			}
+			expected = expected[:size]
+		case 3:
+			writeBuf := make([]byte, rand.Intn(MaxOpSize))
+			rand.Read(writeBuf)
+			b.Write(writeBuf)
+			expected = append(expected, writeBuf...)
+		}
+
+		if b.Size() != int64(len(expected)) {
+			t.Fatalf("Size() %d != %d", b.Size(), len(expected))
+		}
+		if len(expected) == 0 {
+			continue
+		}
+		readOff := rand.Intn(len(expected))
+		readBuf := make([]byte, rand.Intn(MaxOpSize))
+		n, err := b.ReadAt(readBuf, int64(readOff))
+		if err != nil && err != io.EOF {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		if !bytes.Equal(readBuf[:n], expected[readOff:readOff+n]) {
+			t.Fatalf("Bytes read != written at iteration %d", i)
+		}
+	}
+
+	readFull := make([]byte, len(expected))
+	_, err := b.ReadAt(readFull, 0)
+	if err != nil && err != io.EOF {
+		t.Errorf("Unexpected read error: %v", err)
+	} else if !bytes.Equal(readFull, expected) {
+		t.Error("Bytes read != written")
+	}
+}
+
+func TestBufferSparse(t *testing.T) {
+	const Offset = 1 << 30
+
+	var b Buffer
+	n, err := b.WriteAt([]byte("hello"), Offset)
+	if err != nil || n != 5 {
+		t.Errorf("WriteAt() = %d, %v", n, err)
+	}
+	if b.Size() != Offset+5 {
+		t.Errorf("Size() %d != %d", b.Size(), Offset+5)
+	}
+	if b.CompressedSize() > BlockSize {
+		t.Errorf("CompressedSize() %d too large for sparse buffer", b.CompressedSize())
+	}
+	if len(b.blocks) != Offset/BlockSize {
+		t.Errorf("len(blocks) %d != %d", len(b.blocks), Offset/BlockSize)
+	}
+
+	readBuf := make([]byte, 10)
+	n, err = b.ReadAt(readBuf, Offset-5)
+	if err != nil || n != 10 {
+		t.Errorf("ReadAt() = %d, %v", n, err)
+	}
+	if !bytes.Equal(readBuf, []byte("\x00\x00\x00\x00\x00hello")) {
+		t.Errorf("ReadAt() data %q", readBuf)
+	}
+
+	if err := b.Truncate(BlockSize + 1); err != nil {
+		t.Errorf("Truncate() error %v", err)
+	}
+	if b.Size() != BlockSize+1 || b.CompressedSize() != 1 {
+		t.Errorf("Size() %d, CompressedSize() %d after Truncate()", b.Size(), b.CompressedSize())
+	}
+	if err := b.Truncate(-1); err != ErrNegativeSize {
+		t.Errorf("Truncate(-1) error %v != ErrNegativeSize", err)
+	}
+	if _, err := b.WriteAt([]byte("x"), -1); err != ErrNegativeOffset {
+		t.Errorf("WriteAt(-1) error %v != ErrNegativeOffset", err)
+	}
+	if _, err := b.ReadAt(make([]byte, 1), -1); err != ErrNegativeOffset {
+		t.Errorf("ReadAt(-1) error %v != ErrNegativeOffset", err)
+	}
+}
+
+func TestBufferCompressionWorkers(t *testing.T) {
+	const NumBlocks = 256
+	data := bytes.Repeat([]byte("compressible data "), NumBlocks*BlockSize/18+1)[:NumBlocks*BlockSize]
+
+	b := NewBuffer(&Options{CompressionWorkers: 4})
+	readBuf := make([]byte, 3*BlockSize/2)
+	for off := 0; off < len(data); off += len(readBuf) {
+		end := off + len(readBuf)
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := b.Write(data[off:end])
+		if err != nil || n != end-off {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+
+		// Read back data which may still be waiting to be compressed.
+		readOff := rand.Intn(end)
+		n, err = b.ReadAt(readBuf, int64(readOff))
+		if err != nil && err != io.EOF {
+			t.Fatalf("Unexpected read error: %v", err)
+		} else if !bytes.Equal(readBuf[:n], data[readOff:readOff+n]) {
+			t.Fatalf("Bytes read != written at offset %d", readOff)
+		}
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush() error %v", err)
+	}
+	for i, blk := range b.blocks {
+		if blk.pending || blk.raw {
+			t.Errorf("Block %d not compressed after Flush()", i)
+		}
+	}
+	if b.CompressedSize() >= b.Size()/4 {
+		t.Errorf("CompressedSize() %d too large for size %d", b.CompressedSize(), b.Size())
+	}
+
+	readFull := make([]byte, len(data))
+	if _, err := b.ReadAt(readFull, 0); err != nil && err != io.EOF {
+		t.Errorf("Unexpected read error: %v", err)
+	} else if !bytes.Equal(readFull, data) {
+		t.Error("Bytes read != written")
+	}
+}
+
+func TestBufferCorrupt(t *testing.T) {
+	compressible := bytes.Repeat([]byte("corrupt"), 2*BlockSize)
+	incompressible := make([]byte, 2*BlockSize)
+	rand.Read(incompressible)
+
+	for _, data := range [][]byte{compressible, incompressible} {
+		b := NewBuffer(&Options{CacheBlocks: -1})
+		b.Write(data)
+		readBuf := make([]byte, len(data))
+		if _, err := b.ReadAt(readBuf, 0); err != nil && err != io.EOF {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+
+		// Simulate memory corruption of the second block.
+		blk := b.blocks[1]
+		blk.data = append([]byte(nil), blk.data...)
+		blk.data[len(blk.data)/2] ^= 0x01
+		b.blocks[1] = blk
+
+		n, err := b.ReadAt(readBuf, 0)
+		var corruptErr *ErrCorrupt
+		if !errors.As(err, &corruptErr) {
+			t.Errorf("ReadAt() error %v != ErrCorrupt", err)
+		} else if corruptErr.Block != 1 {
+			t.Errorf("ErrCorrupt.Block %d != 1", corruptErr.Block)
+		} else if n != BlockSize {
+			t.Errorf("ReadAt() = %d, expected %d", n, BlockSize)
+		}
+		if _, err := b.WriteAt([]byte("x"), BlockSize+1); !errors.As(err, &corruptErr) {
+			t.Errorf("WriteAt() error %v != ErrCorrupt", err)
+		}
+	}
+}
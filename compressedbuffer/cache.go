@@ -0,0 +1,161 @@
+package compressedbuffer
+
+import (
+	"container/list"
+	"hash/crc32"
+	"sync"
+)
+
+const (
+	DefaultCacheBlocks = 4
+)
+
+// CacheStats contains counters for the decompressed block cache. Only
+// compressed blocks are counted, since zero and uncompressed blocks are read
+// without decompression.
+type CacheStats struct {
+	Hits, Misses uint64
+}
+
+// cacheKey uniquely identifies the contents of a compressed block. Keys are
+// never reused for different contents, so stale entries are never returned.
+type cacheKey uint64
+
+type cacheEntry struct {
+	key  cacheKey
+	data *[]byte
+}
+
+// blockCache is an LRU cache of decompressed blocks. Any concurrent use MUST
+// be externally synchronized.
+type blockCache struct {
+	// If zero, DefaultCacheBlocks is used. If negative, nothing is cached.
+	capacity int
+
+	entries map[cacheKey]*list.Element
+	lru     list.List
+	stats   CacheStats
+}
+
+// get copies the cached block with key, starting at off, into dst. Returns
+// false if the block isn't cached.
+func (c *blockCache) get(key cacheKey, dst []byte, off int) bool {
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	copy(dst, (*e.Value.(*cacheEntry).data)[off:])
+	return true
+}
+
+// put adds data to the cache, and returns a buffer which is no longer used by
+// the cache, and may be reused. The returned buffer may be data itself, if
+// caching is disabled.
+func (c *blockCache) put(key cacheKey, data *[]byte) *[]byte {
+	capacity := c.capacity
+	if capacity == 0 {
+		capacity = DefaultCacheBlocks
+	} else if capacity < 0 {
+		return data
+	}
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*list.Element)
+	}
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		old := entry.data
+		entry.data = data
+		c.lru.MoveToFront(e)
+		return old
+	}
+
+	var evicted *[]byte
+	for c.lru.Len() >= capacity {
+		evicted = c.remove(c.lru.Back().Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	return evicted
+}
+
+func (c *blockCache) remove(key cacheKey) *[]byte {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.Remove(e)
+	delete(c.entries, key)
+	return e.Value.(*cacheEntry).data
+}
+
+// decompressor decompresses blocks through a shared cache, using pooled
+// scratch buffers. decompressor is safe for concurrent use. All blocks MUST
+// have the same uncompressed size.
+type decompressor struct {
+	cache       blockCache
+	lock        sync.Mutex
+	scratchPool sync.Pool
+}
+
+func (d *decompressor) getScratch(blockSize int) *[]byte {
+	if buf, ok := d.scratchPool.Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, blockSize)
+	return &buf
+}
+
+func (d *decompressor) putScratch(buf *[]byte) {
+	if buf != nil {
+		d.scratchPool.Put(buf)
+	}
+}
+
+// read copies the uncompressed contents of block i, identified by key,
+// starting at off, into dst. If the block isn't cached, load is called to
+// obtain its compressed data, and the decompressed block is verified against
+// crc.
+func (d *decompressor) read(codec Codec, blockSize int, i int, key cacheKey, crc uint32, dst []byte, off int, load func() ([]byte, error)) error {
+	d.lock.Lock()
+	ok := d.cache.get(key, dst, off)
+	d.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	compressed, err := load()
+	if err != nil {
+		return err
+	}
+	buf := d.getScratch(blockSize)
+	err = codec.Decompress(*buf, compressed)
+	if err == nil && crc32.Checksum(*buf, crcTable) != crc {
+		err = errChecksum
+	}
+	if err != nil {
+		d.putScratch(buf)
+		return &ErrCorrupt{Block: i, Err: err}
+	}
+	copy(dst, (*buf)[off:])
+
+	d.lock.Lock()
+	buf = d.cache.put(key, buf)
+	d.lock.Unlock()
+	d.putScratch(buf)
+	return nil
+}
+
+func (d *decompressor) remove(key cacheKey) {
+	d.lock.Lock()
+	buf := d.cache.remove(key)
+	d.lock.Unlock()
+	d.putScratch(buf)
+}
+
+func (d *decompressor) stats() CacheStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cache.stats
+}
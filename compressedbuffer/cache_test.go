@@ -0,0 +1,169 @@
+package compressedbuffer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestBufferBlockSize(t *testing.T) {
+	for _, size := range []int{1, 100, 512, 65536} {
+		b := NewBuffer(&Options{BlockSize: size})
+		checkWriteRead(t, b, size-1)
+		checkWriteRead(t, b, size)
+		checkWriteRead(t, b, 3*size+1)
+		if len(b.blocks) != int(b.Size())/size {
+			t.Errorf("Block size %d: len(blocks) %d != %d", size, len(b.blocks), int(b.Size())/size)
+		}
+
+		if _, err := b.WriteAt([]byte{1, 2, 3}, b.Size()+int64(5*size)); err != nil {
+			t.Errorf("Unexpected WriteAt error: %v", err)
+		}
+		if err := b.Truncate(int64(size) + 1); err != nil {
+			t.Errorf("Unexpected Truncate error: %v", err)
+		}
+		checkWriteRead(t, b, 2*size)
+	}
+}
+
+func TestBufferCache(t *testing.T) {
+	const blockSize = 1024
+	const numBlocks = 8
+	data := bytes.Repeat([]byte("compressible"), numBlocks*blockSize/12+1)[:numBlocks*blockSize]
+
+	b := NewBuffer(&Options{BlockSize: blockSize, CacheBlocks: 2})
+	b.Write(data)
+
+	readBlock := func(i int) {
+		t.Helper()
+		buf := make([]byte, blockSize)
+		n, err := b.ReadAt(buf, int64(i*blockSize))
+		if err != nil || n != blockSize {
+			t.Fatalf("ReadAt(block %d) = %d, %v", i, n, err)
+		} else if !bytes.Equal(buf, data[i*blockSize:(i+1)*blockSize]) {
+			t.Fatalf("Block %d read != written", i)
+		}
+	}
+	checkStats := func(hits, misses uint64) {
+		t.Helper()
+		stats := b.CacheStats()
+		if stats.Hits != hits || stats.Misses != misses {
+			t.Errorf("CacheStats %+v != {Hits:%d Misses:%d}", stats, hits, misses)
+		}
+	}
+
+	readBlock(0)
+	readBlock(1)
+	checkStats(0, 2)
+	readBlock(0)
+	readBlock(1)
+	checkStats(2, 2)
+
+	// Evicts block 0, the least recently used.
+	readBlock(2)
+	checkStats(2, 3)
+	readBlock(1)
+	readBlock(0)
+	checkStats(3, 4)
+
+	// Overwritten blocks must not be served from the cache. Patching block 0
+	// reads it through the cache.
+	patch := []byte("patched")
+	b.WriteAt(patch, 0)
+	copy(data, patch)
+	checkStats(4, 4)
+	readBlock(0)
+	checkStats(4, 5)
+}
+
+func TestBufferCacheDisabled(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, DefaultBlockSize)
+	b := NewBuffer(&Options{CacheBlocks: -1})
+	b.Write(data)
+
+	buf := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		b.ReadAt(buf, 0)
+	}
+	if stats := b.CacheStats(); stats.Hits != 0 || stats.Misses != 4 {
+		t.Errorf("CacheStats %+v != {Hits:0 Misses:4}", stats)
+	}
+	if len(b.decomp.cache.entries) != 0 {
+		t.Errorf("Cache contains %d entries", len(b.decomp.cache.entries))
+	}
+}
+
+func newCompressibleBuffer(opts *Options, size int) (*Buffer, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rand.Intn(16))
+	}
+	b := NewBuffer(opts)
+	b.Write(data)
+	return b, data
+}
+
+func TestBufferConcurrentRead(t *testing.T) {
+	const Size = 256 * BlockSize
+	const Readers = 8
+	const MaxReadSize = 3 * BlockSize
+
+	rand.Seed(5)
+	b, data := newCompressibleBuffer(nil, Size)
+
+	var wg sync.WaitGroup
+	for i := 0; i < Readers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			buf := make([]byte, MaxReadSize)
+			for j := 0; j < 500; j++ {
+				off := r.Intn(Size)
+				n, err := b.ReadAt(buf[:r.Intn(MaxReadSize)], int64(off))
+				if err != nil && err != io.EOF {
+					t.Errorf("Unexpected read error: %v", err)
+					return
+				} else if !bytes.Equal(buf[:n], data[off:off+n]) {
+					t.Errorf("Bytes read != written at offset %d", off)
+					return
+				}
+			}
+		}(int64(i))
+	}
+
+	// Concurrently overwrite with identical data, to invalidate blocks while
+	// they are being read.
+	for off := 0; off < Size; off += BlockSize / 2 {
+		b.WriteAt(data[off:off+BlockSize/2], int64(off))
+	}
+	wg.Wait()
+}
+
+func benchmarkReadAtParallel(b *testing.B, opts *Options) {
+	const Size = 1024 * BlockSize
+	const ReadSize = 512
+
+	buf, _ := newCompressibleBuffer(opts, Size)
+	b.SetBytes(ReadSize)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		p := make([]byte, ReadSize)
+		for pb.Next() {
+			buf.ReadAt(p, int64(r.Intn(Size-ReadSize)))
+		}
+	})
+}
+
+// Run with -cpu=1,2,4,8 to show scaling with concurrent readers.
+func BenchmarkReadAtParallel(b *testing.B) {
+	b.Run("Cached", func(b *testing.B) {
+		benchmarkReadAtParallel(b, nil)
+	})
+	b.Run("Uncached", func(b *testing.B) {
+		benchmarkReadAtParallel(b, &Options{CacheBlocks: -1})
+	})
+}
@@ -0,0 +1,205 @@
+package compressedbuffer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec compresses and decompresses blocks of data. Codecs MUST be safe for
+// concurrent use.
+type Codec interface {
+	// Name returns a short, unique name of the codec.
+	Name() string
+
+	// Compress appends the compressed form of src to dst, and returns the
+	// updated slice.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decompresses src into dst. len(dst) is the size of the
+	// uncompressed data.
+	Decompress(dst, src []byte) error
+}
+
+var (
+	// DefaultCodec is used by buffers without an explicit codec.
+	DefaultCodec Codec = NewZlibCodec(zlib.BestSpeed)
+
+	// NoneCodec stores data uncompressed.
+	NoneCodec Codec = noneCodec{}
+
+	ErrUnknownCodec = errors.New("compressedbuffer: unknown codec")
+
+	registeredCodecs     = make(map[string]Codec)
+	registeredCodecsLock sync.Mutex
+)
+
+// RegisterCodec makes c available by name to Open. The built-in zlib, flate,
+// and none codecs do not need to be registered.
+func RegisterCodec(c Codec) {
+	registeredCodecsLock.Lock()
+	defer registeredCodecsLock.Unlock()
+	registeredCodecs[c.Name()] = c
+}
+
+// lookupCodec returns the codec with the given name.
+func lookupCodec(name string) (Codec, error) {
+	registeredCodecsLock.Lock()
+	c, ok := registeredCodecs[name]
+	registeredCodecsLock.Unlock()
+	if ok {
+		return c, nil
+	} else if name == NoneCodec.Name() {
+		return NoneCodec, nil
+	} else if name == DefaultCodec.Name() {
+		return DefaultCodec, nil
+	}
+
+	// zlib and flate use the same range of compression levels.
+	var newCodec func(int) Codec
+	var levelStr string
+	if strings.HasPrefix(name, "zlib-") {
+		newCodec, levelStr = NewZlibCodec, name[len("zlib-"):]
+	} else if strings.HasPrefix(name, "flate-") {
+		newCodec, levelStr = NewFlateCodec, name[len("flate-"):]
+	}
+	level, err := strconv.Atoi(levelStr)
+	if newCodec == nil || err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return newCodec(level), nil
+}
+
+// appendWriter is an io.Writer which appends to a slice.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+type streamCodec struct {
+	name       string
+	newWriter  func(io.Writer) (resetWriteCloser, error)
+	newReader  func(io.Reader) (io.ReadCloser, error)
+	resetRead  func(io.ReadCloser, io.Reader) error
+	writerPool sync.Pool
+	readerPool sync.Pool
+}
+
+func (c *streamCodec) Name() string {
+	return c.name
+}
+
+func (c *streamCodec) Compress(dst, src []byte) ([]byte, error) {
+	aw := &appendWriter{buf: dst}
+	var w resetWriteCloser
+	if wi := c.writerPool.Get(); wi != nil {
+		w = wi.(resetWriteCloser)
+		w.Reset(aw)
+	} else {
+		var err error
+		w, err = c.newWriter(aw)
+		if err != nil {
+			return dst, err
+		}
+	}
+	defer c.writerPool.Put(w)
+
+	_, err := w.Write(src)
+	if err != nil {
+		return dst, err
+	}
+	err = w.Close()
+	if err != nil {
+		return dst, err
+	}
+	return aw.buf, nil
+}
+
+func (c *streamCodec) Decompress(dst, src []byte) error {
+	var r io.ReadCloser
+	var err error
+	if ri := c.readerPool.Get(); ri != nil {
+		r = ri.(io.ReadCloser)
+		err = c.resetRead(r, bytes.NewReader(src))
+	} else {
+		r, err = c.newReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return err
+	}
+	defer c.readerPool.Put(r)
+	defer r.Close()
+
+	_, err = io.ReadFull(r, dst)
+	return err
+}
+
+// NewZlibCodec returns a Codec using zlib compression at the given level.
+func NewZlibCodec(level int) Codec {
+	if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+		panic(fmt.Sprintf("compressedbuffer: invalid zlib level %d", level))
+	}
+	return &streamCodec{
+		name: fmt.Sprintf("zlib-%d", level),
+		newWriter: func(w io.Writer) (resetWriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		newReader: zlib.NewReader,
+		resetRead: func(r io.ReadCloser, src io.Reader) error {
+			return r.(zlib.Resetter).Reset(src, nil)
+		},
+	}
+}
+
+// NewFlateCodec returns a Codec using raw DEFLATE compression at the given
+// level. Unlike zlib, no header or checksum is stored.
+func NewFlateCodec(level int) Codec {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		panic(fmt.Sprintf("compressedbuffer: invalid flate level %d", level))
+	}
+	return &streamCodec{
+		name: fmt.Sprintf("flate-%d", level),
+		newWriter: func(w io.Writer) (resetWriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+		resetRead: func(r io.ReadCloser, src io.Reader) error {
+			return r.(flate.Resetter).Reset(src, nil)
+		},
+	}
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decompress(dst, src []byte) error {
+	if len(src) != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(dst, src)
+	return nil
+}
@@ -0,0 +1,88 @@
+package compressedbuffer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"math/rand"
+	"testing"
+)
+
+var testCodecs = []Codec{
+	DefaultCodec,
+	NewZlibCodec(zlib.BestCompression),
+	NewFlateCodec(flate.BestSpeed),
+	NewFlateCodec(flate.DefaultCompression),
+	NoneCodec,
+}
+
+// unregisterCodec removes a codec added by RegisterCodec.
+func unregisterCodec(name string) {
+	registeredCodecsLock.Lock()
+	defer registeredCodecsLock.Unlock()
+	delete(registeredCodecs, name)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	src := make([]byte, 3*BlockSize)
+	for i := range src {
+		src[i] = byte(i % 123)
+	}
+	for _, c := range testCodecs {
+		compressed, err := c.Compress([]byte("prefix"), src)
+		if err != nil {
+			t.Errorf("%s: Compress() error %v", c.Name(), err)
+			continue
+		}
+		if !bytes.HasPrefix(compressed, []byte("prefix")) {
+			t.Errorf("%s: Compress() did not append to dst", c.Name())
+		}
+		dst := make([]byte, len(src))
+		err = c.Decompress(dst, compressed[len("prefix"):])
+		if err != nil {
+			t.Errorf("%s: Decompress() error %v", c.Name(), err)
+		} else if !bytes.Equal(dst, src) {
+			t.Errorf("%s: decompressed data mismatch", c.Name())
+		}
+	}
+}
+
+func TestBufferCodecs(t *testing.T) {
+	for _, c := range testCodecs {
+		b := NewBuffer(&Options{Codec: c})
+		checkWriteRead(t, b, 1)
+		checkWriteRead(t, b, 4*BlockSize)
+		checkWriteRead(t, b, BlockSize+1)
+
+		compressible := make([]byte, 4*BlockSize)
+		writeOff := b.Size()
+		b.Write(compressible)
+		readBuf := make([]byte, len(compressible))
+		n, err := b.ReadAt(readBuf, writeOff)
+		if n != len(readBuf) || err != nil {
+			t.Errorf("%s: ReadAt() = %d, %v", c.Name(), n, err)
+		} else if !bytes.Equal(readBuf, compressible) {
+			t.Errorf("%s: Bytes read != written", c.Name())
+		}
+	}
+}
+
+func TestBufferIncompressible(t *testing.T) {
+	const size = 16 * BlockSize
+
+	buf := make([]byte, size)
+	rand.Read(buf)
+
+	var b Buffer
+	b.Write(buf)
+	// Random data doesn't compress, so blocks must be stored raw, and not
+	// expanded.
+	if b.CompressedSize() != size {
+		t.Errorf("CompressedSize() %d != %d", b.CompressedSize(), size)
+	}
+	readBuf := make([]byte, size)
+	b.ReadAt(readBuf, 0)
+	if !bytes.Equal(readBuf, buf) {
+		t.Error("Bytes read != written")
+	}
+}
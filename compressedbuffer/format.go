@@ -0,0 +1,350 @@
+package compressedbuffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Serialized format, with all integers little-endian:
+//
+//	Header:
+//	  magic        [4]byte "CBUF"
+//	  version      uint16
+//	  reserved     uint16
+//	  block size   uint32
+//	  size         uint64 (uncompressed)
+//	  num blocks   uint64
+//	  codec length uint16
+//	  codec name   [codec length]byte
+//	Index, one entry per block:
+//	  offset       uint64 (from the start of the header)
+//	  length       uint32
+//	  flags        uint8
+//	  checksum     uint32 (CRC-32C of the stored block data)
+//	  checksum     uint32 (CRC-32C of the uncompressed block data)
+//	Index checksum uint32 (CRC-32C of the header and index)
+//	Block data
+//
+// Zero blocks are not stored, and have a length of 0. The final block may be
+// partial, in which case it is stored uncompressed.
+const (
+	formatMagic   = "CBUF"
+	formatVersion = 2
+
+	headerFixedSize = 30
+	indexEntrySize  = 21
+
+	flagZero = 1 << 0
+	flagRaw  = 1 << 1
+
+	// Number of index entries read at a time by Open.
+	indexChunkEntries = 4096
+)
+
+var (
+	ErrInvalidFormat = errors.New("compressedbuffer: invalid serialized format")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type indexEntry struct {
+	off    int64
+	length uint32
+	flags  uint8
+	crc    uint32
+
+	// CRC-32C of the uncompressed block.
+	dataCRC uint32
+}
+
+// WriteTo writes the buffer to w in a serialized form, which can be read
+// using Open. Compressed blocks are written as-is, without decompression.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	b.lock.RLock()
+	blocks := append([]block(nil), b.blocks...)
+	tail := append([]byte(nil), b.writeBuf.Bytes()...)
+	size := b.size
+	blockSize := b.getBlockSize()
+	codecName := b.getCodec().Name()
+	b.lock.RUnlock()
+
+	if len(tail) > 0 {
+		blocks = append(blocks, block{data: tail, raw: true, crc: crc32.Checksum(tail, crcTable)})
+	}
+
+	headerSize := headerFixedSize + len(codecName) + len(blocks)*indexEntrySize + 4
+	header := make([]byte, headerSize)
+	copy(header, formatMagic)
+	binary.LittleEndian.PutUint16(header[4:], formatVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(blockSize))
+	binary.LittleEndian.PutUint64(header[12:], uint64(size))
+	binary.LittleEndian.PutUint64(header[20:], uint64(len(blocks)))
+	binary.LittleEndian.PutUint16(header[28:], uint16(len(codecName)))
+	copy(header[headerFixedSize:], codecName)
+
+	entries := header[headerFixedSize+len(codecName):]
+	off := int64(headerSize)
+	for i, blk := range blocks {
+		e := indexEntry{length: uint32(blk.storedLen()), dataCRC: blk.crc}
+		if blk.isZero() {
+			e.flags = flagZero
+		} else {
+			e.off = off
+			if blk.fileLen > 0 {
+				e.crc = blk.fileCRC
+			} else {
+				e.crc = crc32.Checksum(blk.data, crcTable)
+			}
+			if blk.raw {
+				e.flags = flagRaw
+			}
+		}
+		off += int64(e.length)
+
+		entry := entries[i*indexEntrySize:]
+		binary.LittleEndian.PutUint64(entry, uint64(e.off))
+		binary.LittleEndian.PutUint32(entry[8:], e.length)
+		entry[12] = e.flags
+		binary.LittleEndian.PutUint32(entry[13:], e.crc)
+		binary.LittleEndian.PutUint32(entry[17:], e.dataCRC)
+	}
+	binary.LittleEndian.PutUint32(header[headerSize-4:], crc32.Checksum(header[:headerSize-4], crcTable))
+
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for i, blk := range blocks {
+		data, err := b.storedData(i, blk)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reader provides read-only random access to a Buffer serialized using
+// Buffer.WriteTo. Blocks are read from the underlying io.ReaderAt on demand.
+// Reader is safe for concurrent use.
+type Reader struct {
+	r              io.ReaderAt
+	codec          Codec
+	blockSize      int
+	size           int64
+	compressedSize int64
+	index          []indexEntry
+
+	decomp decompressor
+}
+
+// sizer is implemented by readers which know their size, such as
+// bytes.Reader and io.SectionReader.
+type sizer interface {
+	Size() int64
+}
+
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Open reads the header and block index of a Buffer serialized using
+// Buffer.WriteTo. If a non-builtin codec was used, it MUST be registered
+// using RegisterCodec.
+func Open(r io.ReaderAt) (*Reader, error) {
+	fixed := make([]byte, headerFixedSize)
+	if err := readFull(r, fixed, 0); err != nil {
+		return nil, err
+	}
+	if string(fixed[:4]) != formatMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFormat)
+	} else if v := binary.LittleEndian.Uint16(fixed[4:]); v != formatVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFormat, v)
+	}
+	blockSize := int64(binary.LittleEndian.Uint32(fixed[8:]))
+	size := int64(binary.LittleEndian.Uint64(fixed[12:]))
+	numBlocks := binary.LittleEndian.Uint64(fixed[20:])
+	codecLen := int(binary.LittleEndian.Uint16(fixed[28:]))
+	if blockSize == 0 || size < 0 || numBlocks > math.MaxInt32 ||
+		numBlocks != uint64((size+blockSize-1)/blockSize) {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidFormat)
+	}
+
+	codecName := make([]byte, codecLen)
+	if err := readFull(r, codecName, headerFixedSize); err != nil {
+		return nil, err
+	}
+	crc := crc32.Checksum(fixed, crcTable)
+	crc = crc32.Update(crc, crcTable, codecName)
+
+	// Header fields are not yet verified, so avoid allocating memory based on
+	// them. If the input size is known, reject an index which can't fit.
+	// Otherwise, read the index in chunks, so that memory use is bounded by
+	// the size of the input.
+	indexOff := int64(headerFixedSize + codecLen)
+	if sr, ok := r.(sizer); ok && indexOff+int64(numBlocks)*indexEntrySize+4 > sr.Size() {
+		return nil, fmt.Errorf("%w: index larger than input", ErrInvalidFormat)
+	}
+	chunkEntries := uint64(indexChunkEntries)
+	if numBlocks < chunkEntries {
+		chunkEntries = numBlocks
+	}
+	chunk := make([]byte, chunkEntries*indexEntrySize)
+	var index []indexEntry
+	for uint64(len(index)) < numBlocks {
+		n := numBlocks - uint64(len(index))
+		if n > chunkEntries {
+			n = chunkEntries
+		}
+		buf := chunk[:n*indexEntrySize]
+		if err := readFull(r, buf, indexOff); err != nil {
+			return nil, err
+		}
+		crc = crc32.Update(crc, crcTable, buf)
+		indexOff += int64(len(buf))
+		for ; len(buf) > 0; buf = buf[indexEntrySize:] {
+			index = append(index, indexEntry{
+				off:     int64(binary.LittleEndian.Uint64(buf)),
+				length:  binary.LittleEndian.Uint32(buf[8:]),
+				flags:   buf[12],
+				crc:     binary.LittleEndian.Uint32(buf[13:]),
+				dataCRC: binary.LittleEndian.Uint32(buf[17:]),
+			})
+		}
+	}
+	var crcBuf [4]byte
+	if err := readFull(r, crcBuf[:], indexOff); err != nil {
+		return nil, err
+	}
+	if crc != binary.LittleEndian.Uint32(crcBuf[:]) {
+		return nil, fmt.Errorf("%w: index checksum mismatch", ErrInvalidFormat)
+	}
+
+	codec, err := lookupCodec(string(codecName))
+	if err != nil {
+		return nil, err
+	}
+	rd := &Reader{
+		r:         r,
+		codec:     codec,
+		blockSize: int(blockSize),
+		size:      size,
+		index:     index,
+	}
+
+	for i, e := range rd.index {
+		if e.flags&flagZero != 0 {
+			if e.length != 0 {
+				return nil, fmt.Errorf("%w: non-empty zero block %d", ErrInvalidFormat, i)
+			}
+		} else if e.flags&flagRaw != 0 {
+			if int(e.length) != rd.uncompressedLen(i) {
+				return nil, fmt.Errorf("%w: bad uncompressed block %d length", ErrInvalidFormat, i)
+			}
+		} else if i == len(rd.index)-1 && rd.uncompressedLen(i) != rd.blockSize {
+			return nil, fmt.Errorf("%w: compressed partial block", ErrInvalidFormat)
+		}
+		rd.compressedSize += int64(e.length)
+	}
+	return rd, nil
+}
+
+// uncompressedLen returns the uncompressed length of block i.
+func (r *Reader) uncompressedLen(i int) int {
+	if i == len(r.index)-1 {
+		if rem := int(r.size % int64(r.blockSize)); rem != 0 {
+			return rem
+		}
+	}
+	return r.blockSize
+}
+
+func (r *Reader) loadBlock(i int) ([]byte, error) {
+	e := r.index[i]
+	buf := make([]byte, e.length)
+	if err := readFull(r.r, buf, e.off); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buf, crcTable) != e.crc {
+		return nil, &ErrCorrupt{Block: i, Err: errChecksum}
+	}
+	return buf, nil
+}
+
+func (r *Reader) readBlockInto(i int, dst []byte, off int) error {
+	e := r.index[i]
+	if e.flags&flagZero != 0 {
+		copy(dst, zeroBytes(len(dst)))
+		return nil
+	} else if e.flags&flagRaw != 0 {
+		data, err := r.loadBlock(i)
+		if err != nil {
+			return err
+		} else if crc32.Checksum(data, crcTable) != e.dataCRC {
+			return &ErrCorrupt{Block: i, Err: errChecksum}
+		}
+		copy(dst, data[off:])
+		return nil
+	}
+	return r.decomp.read(r.codec, r.blockSize, i, cacheKey(i), e.dataCRC, dst, off, func() ([]byte, error) {
+		return r.loadBlock(i)
+	})
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
+	blockSize := int64(r.blockSize)
+	bytesRead := 0
+	for len(p) > 0 {
+		if off >= r.size {
+			return bytesRead, io.EOF
+		}
+		i := int(off / blockSize)
+		blockOff := int(off % blockSize)
+
+		n := r.uncompressedLen(i) - blockOff
+		if n > len(p) {
+			n = len(p)
+		}
+		err := r.readBlockInto(i, p[:n], blockOff)
+		if err != nil {
+			return bytesRead, err
+		}
+		bytesRead += n
+		p = p[n:]
+		off += int64(n)
+	}
+	return bytesRead, nil
+}
+
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// CompressedSize returns the total size of stored blocks.
+func (r *Reader) CompressedSize() int64 {
+	return r.compressedSize
+}
+
+// CacheStats returns the hit and miss counts of the decompressed block cache.
+func (r *Reader) CacheStats() CacheStats {
+	return r.decomp.stats()
+}
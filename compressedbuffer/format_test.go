@@ -0,0 +1,188 @@
+package compressedbuffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+func checkSerialized(t *testing.T, b *Buffer, expected []byte) *Reader {
+	t.Helper()
+
+	var out bytes.Buffer
+	n, err := b.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("WriteTo() error %v", err)
+	} else if n != int64(out.Len()) {
+		t.Errorf("WriteTo() = %d, wrote %d", n, out.Len())
+	}
+
+	r, err := Open(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("Open() error %v", err)
+	}
+	if r.Size() != int64(len(expected)) {
+		t.Errorf("Size() %d != %d", r.Size(), len(expected))
+	}
+
+	readFull := make([]byte, len(expected)+1)
+	n2, err := r.ReadAt(readFull, 0)
+	if err != io.EOF || n2 != len(expected) {
+		t.Errorf("ReadAt() = %d, %v", n2, err)
+	} else if !bytes.Equal(readFull[:n2], expected) {
+		t.Error("Bytes read != written")
+	}
+	for i := 0; i < 100 && len(expected) > 0; i++ {
+		off := rand.Intn(len(expected))
+		readBuf := make([]byte, rand.Intn(3*BlockSize))
+		n, err := r.ReadAt(readBuf, int64(off))
+		if err != nil && err != io.EOF {
+			t.Fatalf("Unexpected read error: %v", err)
+		} else if !bytes.Equal(readBuf[:n], expected[off:off+n]) {
+			t.Fatalf("Bytes read != written at offset %d", off)
+		}
+	}
+	return r
+}
+
+func TestSerialize(t *testing.T) {
+	rand.Seed(6)
+	compressible := make([]byte, 10*BlockSize+123)
+	for i := range compressible {
+		compressible[i] = byte(rand.Intn(4))
+	}
+	incompressible := make([]byte, 3*BlockSize)
+	rand.Read(incompressible)
+
+	checkSerialized(t, &Buffer{}, nil)
+
+	for _, opts := range []*Options{
+		nil,
+		{Codec: NoneCodec},
+		{Codec: NewFlateCodec(9)},
+		{BlockSize: 1000},
+		{CompressionWorkers: 2},
+	} {
+		b := NewBuffer(opts)
+		b.Write(compressible)
+		b.Write(incompressible)
+		b.WriteAt([]byte("sparse"), 1<<20)
+		expected := append(append([]byte(nil), compressible...), incompressible...)
+		expected = append(expected, make([]byte, 1<<20-len(expected))...)
+		expected = append(expected, "sparse"...)
+
+		r := checkSerialized(t, b, expected)
+		if r.CompressedSize() >= r.Size()/2 {
+			t.Errorf("CompressedSize() %d too large for size %d", r.CompressedSize(), r.Size())
+		}
+	}
+}
+
+type testCodec struct {
+	Codec
+}
+
+func (testCodec) Name() string {
+	return "test-codec"
+}
+
+func TestSerializeCodecs(t *testing.T) {
+	var out bytes.Buffer
+	b := NewBuffer(&Options{Codec: testCodec{NoneCodec}})
+	b.Write(make([]byte, 10))
+	b.WriteTo(&out)
+
+	_, err := Open(bytes.NewReader(out.Bytes()))
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Open() error %v != ErrUnknownCodec", err)
+	}
+
+	RegisterCodec(testCodec{NoneCodec})
+	t.Cleanup(func() { unregisterCodec(testCodec{}.Name()) })
+	if _, err := Open(bytes.NewReader(out.Bytes())); err != nil {
+		t.Errorf("Open() error %v", err)
+	}
+}
+
+func TestSerializeCorrupt(t *testing.T) {
+	data := bytes.Repeat([]byte("corrupt"), 2*BlockSize)
+	b := NewBuffer(nil)
+	b.Write(data)
+
+	var out bytes.Buffer
+	b.WriteTo(&out)
+	serialized := out.Bytes()
+
+	if _, err := Open(bytes.NewReader(serialized[:20])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Open(truncated) error %v != io.ErrUnexpectedEOF", err)
+	}
+
+	badMagic := append([]byte("XBUF"), serialized[4:]...)
+	if _, err := Open(bytes.NewReader(badMagic)); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Open(bad magic) error %v != ErrInvalidFormat", err)
+	}
+
+	badIndex := append([]byte(nil), serialized...)
+	badIndex[headerFixedSize+len(DefaultCodec.Name())]++
+	if _, err := Open(bytes.NewReader(badIndex)); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Open(bad index) error %v != ErrInvalidFormat", err)
+	}
+
+	// Corrupting block data is only detected when the block is read.
+	badBlock := append([]byte(nil), serialized...)
+	badBlock[len(badBlock)-1]++
+	r, err := Open(bytes.NewReader(badBlock))
+	if err != nil {
+		t.Fatalf("Open(bad block) error %v", err)
+	}
+	readBuf := make([]byte, len(data))
+	if _, err := r.ReadAt(readBuf[:BlockSize], 0); err != nil {
+		t.Errorf("ReadAt(good block) error %v", err)
+	}
+	n, err := r.ReadAt(readBuf, 0)
+	var corruptErr *ErrCorrupt
+	if !errors.As(err, &corruptErr) {
+		t.Errorf("ReadAt(bad block) error %v != ErrCorrupt", err)
+	} else if corruptErr.Block != len(data)/BlockSize-1 {
+		t.Errorf("ErrCorrupt.Block %d != %d", corruptErr.Block, len(data)/BlockSize-1)
+	} else if n != len(data)-BlockSize {
+		t.Errorf("ReadAt(bad block) = %d, expected %d", n, len(data)-BlockSize)
+	}
+}
+
+// readerAtOnly hides the Size method of the underlying reader.
+type readerAtOnly struct {
+	io.ReaderAt
+}
+
+func TestOpenHostileHeader(t *testing.T) {
+	const NumBlocks = 1 << 30
+
+	// A valid-looking header claiming a huge index, with no index following.
+	header := make([]byte, headerFixedSize)
+	copy(header, formatMagic)
+	binary.LittleEndian.PutUint16(header[4:], formatVersion)
+	binary.LittleEndian.PutUint32(header[8:], 1)
+	binary.LittleEndian.PutUint64(header[12:], NumBlocks)
+	binary.LittleEndian.PutUint64(header[20:], NumBlocks)
+
+	if _, err := Open(bytes.NewReader(header)); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Open(huge index) error %v != ErrInvalidFormat", err)
+	}
+
+	// Without a known input size, the index is read in bounded chunks.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Open(readerAtOnly{bytes.NewReader(header)})
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Open(huge index) error %v != io.ErrUnexpectedEOF", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Open(huge index) allocated %d bytes", alloc)
+	}
+}
@@ -0,0 +1,99 @@
+package compressedbuffer
+
+import (
+	"hash/crc32"
+
+	"github.com/akmistry/go-util/tempfile"
+)
+
+// account adds (delta == 1) or removes (delta == -1) blk from the buffer's
+// size accounting.
+func (b *Buffer) account(blk block, delta int64) {
+	stored := delta * int64(blk.storedLen())
+	b.compressedSize += stored
+	if blk.fileLen == 0 {
+		b.memorySize += stored
+	}
+}
+
+// maybeSpill moves the oldest blocks to the temporary file, until the size of
+// blocks held in memory is under the memory limit. Blocks waiting for
+// background compression are not moved.
+func (b *Buffer) maybeSpill() error {
+	for b.memoryLimit > 0 && b.memorySize > b.memoryLimit && b.spillNext < len(b.blocks) {
+		i := b.spillNext
+		b.spillNext++
+		blk := b.blocks[i]
+		if blk.data == nil || blk.pending {
+			continue
+		}
+		if err := b.spillBlock(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Buffer) spillBlock(i int) error {
+	if b.spillFile == nil {
+		f, err := tempfile.MakeTempFile(b.tempDir)
+		if err != nil {
+			return err
+		}
+		b.spillFile = f
+	}
+
+	blk := b.blocks[i]
+	_, err := b.spillFile.WriteAt(blk.data, b.spillEnd)
+	if err != nil {
+		return err
+	}
+	b.memorySize -= int64(len(blk.data))
+	blk.fileOff = b.spillEnd
+	blk.fileLen = len(blk.data)
+	blk.fileCRC = crc32.Checksum(blk.data, crcTable)
+	blk.data = nil
+	// Space used by overwritten or truncated blocks is not reused.
+	b.spillEnd += int64(blk.fileLen)
+	b.blocks[i] = blk
+	return nil
+}
+
+// storedData returns the data stored for blk, block i, reading it from the
+// temporary file if necessary.
+func (b *Buffer) storedData(i int, blk block) ([]byte, error) {
+	if blk.fileLen == 0 {
+		return blk.data, nil
+	}
+	buf := make([]byte, blk.fileLen)
+	if err := readFull(b.spillFile, buf, blk.fileOff); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buf, crcTable) != blk.fileCRC {
+		return nil, &ErrCorrupt{Block: i, Err: errFileChecksum}
+	}
+	return buf, nil
+}
+
+// MemorySize returns the size of compressed blocks held in memory, including
+// the current partial block.
+func (b *Buffer) MemorySize() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.memorySize + int64(b.writeBuf.Len())
+}
+
+// Close waits for any background compression to complete, and removes the
+// temporary file, if one was created. The buffer MUST NOT be used after
+// Close.
+func (b *Buffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.pendingBlocks > 0 {
+		b.cond.Wait()
+	}
+	if b.spillFile == nil {
+		return nil
+	}
+	return b.spillFile.Close()
+}
@@ -0,0 +1,205 @@
+package compressedbuffer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBufferSpill(t *testing.T) {
+	const Size = 256 * BlockSize
+	const MemoryLimit = 16 * BlockSize
+
+	rand.Seed(7)
+	data := make([]byte, Size)
+	for i := range data {
+		data[i] = byte(rand.Intn(16))
+	}
+	// Some incompressible blocks.
+	rand.Read(data[10*BlockSize : 20*BlockSize])
+
+	b := NewBuffer(&Options{MemoryLimit: MemoryLimit, TempDir: t.TempDir()})
+	defer b.Close()
+	b.Write(data)
+
+	if b.spillFile == nil {
+		t.Fatal("Expected blocks to be spilled")
+	}
+	if b.MemorySize() > MemoryLimit {
+		t.Errorf("MemorySize() %d > limit %d", b.MemorySize(), MemoryLimit)
+	}
+	if b.CompressedSize() < b.spillEnd {
+		t.Errorf("CompressedSize() %d < spilled size %d", b.CompressedSize(), b.spillEnd)
+	}
+
+	readFull := make([]byte, Size)
+	if _, err := b.ReadAt(readFull, 0); err != nil && err != io.EOF {
+		t.Errorf("Unexpected read error: %v", err)
+	} else if !bytes.Equal(readFull, data) {
+		t.Error("Bytes read != written")
+	}
+
+	// Overwritten blocks are held in memory, and then spilled again.
+	patch := bytes.Repeat([]byte{0xff}, 2*BlockSize)
+	b.WriteAt(patch, BlockSize/2)
+	copy(data[BlockSize/2:], patch)
+	if b.MemorySize() > MemoryLimit {
+		t.Errorf("MemorySize() %d > limit %d", b.MemorySize(), MemoryLimit)
+	}
+	checkSerialized(t, b, data)
+}
+
+func TestBufferWriteAtStressSpill(t *testing.T) {
+	b := NewBuffer(&Options{
+		MemoryLimit:        4 * BlockSize,
+		CompressionWorkers: 2,
+		TempDir:            t.TempDir(),
+	})
+	testWriteAtStress(t, b)
+	if err := b.Close(); err != nil {
+		t.Errorf("Close() error %v", err)
+	}
+}
+
+type failingCodec struct {
+	Codec
+}
+
+func (failingCodec) Compress(dst, src []byte) ([]byte, error) {
+	return dst, errors.New("compression failed")
+}
+
+func TestBufferSpillCompressionError(t *testing.T) {
+	b := NewBuffer(&Options{
+		Codec:              failingCodec{DefaultCodec},
+		CompressionWorkers: 1,
+		MemoryLimit:        1,
+		TempDir:            t.TempDir(),
+	})
+	defer b.Close()
+
+	data := make([]byte, 3*BlockSize)
+	rand.Read(data)
+	b.Write(data)
+	if err := b.Flush(); err == nil {
+		t.Error("Expected compression error from Flush()")
+	}
+
+	// Blocks which failed compression are kept uncompressed, and spilled.
+	b.lock.Lock()
+	for i, blk := range b.blocks {
+		if blk.pending || blk.fileLen == 0 {
+			t.Errorf("Block %d pending %v, spilled %v", i, blk.pending, blk.fileLen > 0)
+		}
+	}
+	b.lock.Unlock()
+	if b.MemorySize() != 0 {
+		t.Errorf("MemorySize() %d != 0", b.MemorySize())
+	}
+	readFull := make([]byte, len(data))
+	if _, err := b.ReadAt(readFull, 0); err != nil && err != io.EOF {
+		t.Errorf("Unexpected read error: %v", err)
+	} else if !bytes.Equal(readFull, data) {
+		t.Error("Bytes read != written")
+	}
+}
+
+// blockingCodec blocks compression until unblock is closed. If stall is
+// non-zero, only blocks starting with stall are blocked.
+type blockingCodec struct {
+	Codec
+	unblock chan struct{}
+	stall   byte
+}
+
+func (c blockingCodec) Compress(dst, src []byte) ([]byte, error) {
+	if c.stall == 0 || (len(src) > 0 && src[0] == c.stall) {
+		<-c.unblock
+	}
+	return c.Codec.Compress(dst, src)
+}
+
+func TestBufferWriteAtBackpressure(t *testing.T) {
+	const Workers = 1
+	const Blocks = 4 * Workers * pendingBlocksPerWorker
+
+	codec := blockingCodec{Codec: DefaultCodec, unblock: make(chan struct{})}
+	b := NewBuffer(&Options{Codec: codec, CompressionWorkers: Workers})
+
+	data := bytes.Repeat([]byte("backpressure"), BlockSize)[:BlockSize]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < Blocks; i++ {
+			b.WriteAt(data, int64(i*BlockSize))
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	b.lock.Lock()
+	pending := b.pendingBlocks
+	b.lock.Unlock()
+	if pending > Workers*pendingBlocksPerWorker {
+		t.Errorf("%d pending blocks > limit %d", pending, Workers*pendingBlocksPerWorker)
+	}
+
+	close(codec.unblock)
+	<-done
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush() error %v", err)
+	}
+	if b.Size() != Blocks*BlockSize {
+		t.Errorf("Size() %d != %d", b.Size(), Blocks*BlockSize)
+	}
+}
+
+func TestBufferWriteBackpressure(t *testing.T) {
+	const Workers = 1
+	const MaxPending = Workers * pendingBlocksPerWorker
+	const Blocks = 100
+	const MemoryLimit = 8 * BlockSize
+
+	codec := blockingCodec{Codec: DefaultCodec, unblock: make(chan struct{}), stall: 'Q'}
+	b := NewBuffer(&Options{
+		Codec:              codec,
+		CompressionWorkers: Workers,
+		MemoryLimit:        MemoryLimit,
+		TempDir:            t.TempDir(),
+	})
+	defer b.Close()
+
+	// Workers can't start until Write releases the lock, so the first blocks
+	// are queued, and their compression stalls. The remaining blocks MUST NOT
+	// be queued behind them.
+	data := bytes.Repeat([]byte("backpressure"), Blocks*BlockSize)[:Blocks*BlockSize]
+	for i := 0; i < MaxPending; i++ {
+		data[i*BlockSize] = 'Q'
+	}
+	if _, err := b.Write(data); err != nil {
+		t.Fatalf("Write() error %v", err)
+	}
+
+	b.lock.Lock()
+	pending := b.pendingBlocks
+	b.lock.Unlock()
+	if pending > MaxPending {
+		t.Errorf("%d pending blocks > limit %d", pending, MaxPending)
+	}
+	if b.MemorySize() > MemoryLimit {
+		t.Errorf("MemorySize() %d > limit %d", b.MemorySize(), MemoryLimit)
+	}
+
+	close(codec.unblock)
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush() error %v", err)
+	}
+	readFull := make([]byte, len(data))
+	if _, err := b.ReadAt(readFull, 0); err != nil && err != io.EOF {
+		t.Errorf("Unexpected read error: %v", err)
+	} else if !bytes.Equal(readFull, data) {
+		t.Error("Bytes read != written")
+	}
+}
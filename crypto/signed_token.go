@@ -0,0 +1,280 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Length of the random ID assigned to tokens by Issue.
+	TokenIDLength = 32
+
+	// Minimum key size, in bytes, accepted by NewHMACSigner.
+	MinHMACKeySize = 32
+
+	DefaultClockSkew = time.Minute
+)
+
+var (
+	ErrMalformedToken   = errors.New("crypto: malformed token")
+	ErrNoExpiry         = errors.New("crypto: token has no expiry")
+	ErrTokenExpired     = errors.New("crypto: token expired")
+	ErrTokenNotYetValid = errors.New("crypto: token not yet valid")
+	ErrWrongAudience    = errors.New("crypto: token has wrong audience")
+	ErrWrongIssuer      = errors.New("crypto: token has wrong issuer")
+
+	tokenEncoding = base64.RawURLEncoding
+)
+
+type hmacSigner struct {
+	key []byte
+}
+
+// NewHMACSigner returns a Signer using HMAC-SHA256 with key. Since HMAC is
+// symmetric, the signer is also its own Verifier. key MUST be at least
+// MinHMACKeySize bytes.
+func NewHMACSigner(key []byte) (Signer, error) {
+	if len(key) < MinHMACKeySize {
+		return nil, ErrUnsupportedKey
+	}
+	return &hmacSigner{key: append([]byte(nil), key...)}, nil
+}
+
+func (*hmacSigner) Algorithm() string {
+	return "HS256"
+}
+
+func (s *hmacSigner) Sign(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (s *hmacSigner) Verify(msg, sig []byte) error {
+	expected, _ := s.Sign(msg)
+	if !hmac.Equal(expected, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *hmacSigner) Verifier() Verifier {
+	return s
+}
+
+// Claims is the payload of a signed token.
+type Claims struct {
+	// Unique token ID. If empty, Issue generates a random ID.
+	ID string
+
+	Issuer  string
+	Subject string
+
+	// Intended recipients of the token. Verify only accepts the token if
+	// VerifyOptions.Audience is one of these, or if both are empty.
+	Audience []string
+
+	// If zero, Issue uses the current time.
+	IssuedAt time.Time
+	// Optional time before which the token is not valid.
+	NotBefore time.Time
+	// Time after which the token is not valid. Required.
+	ExpiresAt time.Time
+
+	// Application-specific claims. Values MUST be JSON encodable. When
+	// decoded, numbers are float64.
+	Custom map[string]interface{}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+}
+
+// tokenClaims is the encoded form of Claims. Times are in Unix seconds.
+type tokenClaims struct {
+	ID        string                 `json:"jti,omitempty"`
+	Issuer    string                 `json:"iss,omitempty"`
+	Subject   string                 `json:"sub,omitempty"`
+	Audience  []string               `json:"aud,omitempty"`
+	IssuedAt  int64                  `json:"iat"`
+	NotBefore int64                  `json:"nbf,omitempty"`
+	ExpiresAt int64                  `json:"exp"`
+	Custom    map[string]interface{} `json:"ext,omitempty"`
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func encodeTokenPart(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return tokenEncoding.EncodeToString(b), nil
+}
+
+func decodeTokenPart(s string, v interface{}) error {
+	b, err := tokenEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// Issue creates a URL-safe token containing claims, signed using s. The token
+// consists of three base64url encoded parts, separated by '.': a header
+// identifying the signature algorithm, the JSON encoded claims, and the
+// signature of the first two parts.
+func Issue(s Signer, claims *Claims) (string, error) {
+	if claims.ExpiresAt.IsZero() {
+		return "", ErrNoExpiry
+	}
+	c := tokenClaims{
+		ID:        claims.ID,
+		Issuer:    claims.Issuer,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		IssuedAt:  unixOrZero(claims.IssuedAt),
+		NotBefore: unixOrZero(claims.NotBefore),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		Custom:    claims.Custom,
+	}
+	if c.ID == "" {
+		c.ID = GenerateToken(TokenIDLength)
+	}
+	if c.IssuedAt == 0 {
+		c.IssuedAt = time.Now().Unix()
+	}
+
+	header, err := encodeTokenPart(tokenHeader{Alg: s.Algorithm()})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeTokenPart(&c)
+	if err != nil {
+		return "", fmt.Errorf("crypto: failed to encode claims: %w", err)
+	}
+	signed := header + "." + payload
+	sig, err := s.Sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + tokenEncoding.EncodeToString(sig), nil
+}
+
+type VerifyOptions struct {
+	// Audience of the verifier. If non-empty, only tokens whose audience
+	// includes Audience are accepted. If empty, only tokens without an
+	// audience are accepted.
+	Audience string
+
+	// If non-empty, the required token issuer.
+	Issuer string
+
+	// Allowed difference between the issuer's and verifier's clocks. If zero,
+	// DefaultClockSkew is used.
+	ClockSkew time.Duration
+
+	// If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Verify checks the signature, validity period, audience, and issuer of
+// token, and returns its claims. opts may be nil.
+func Verify(v Verifier, token string, opts *VerifyOptions) (*Claims, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, err
+	} else if header.Alg != v.Algorithm() {
+		return nil, ErrInvalidSignature
+	}
+	sig, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+	if err := v.Verify([]byte(signed), sig); err != nil {
+		return nil, err
+	}
+
+	var c tokenClaims
+	if err := decodeTokenPart(parts[1], &c); err != nil {
+		return nil, err
+	}
+
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	skew := opts.ClockSkew
+	if skew == 0 {
+		skew = DefaultClockSkew
+	}
+	t := now()
+	if c.ExpiresAt == 0 {
+		return nil, ErrNoExpiry
+	} else if !t.Add(-skew).Before(time.Unix(c.ExpiresAt, 0)) {
+		return nil, ErrTokenExpired
+	} else if t.Add(skew).Before(time.Unix(c.IssuedAt, 0)) ||
+		(c.NotBefore != 0 && t.Add(skew).Before(time.Unix(c.NotBefore, 0))) {
+		return nil, ErrTokenNotYetValid
+	}
+
+	if len(c.Audience) > 0 || opts.Audience != "" {
+		found := false
+		for _, aud := range c.Audience {
+			if aud == opts.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrWrongAudience
+		}
+	}
+	if opts.Issuer != "" && c.Issuer != opts.Issuer {
+		return nil, ErrWrongIssuer
+	}
+
+	return &Claims{
+		ID:        c.ID,
+		Issuer:    c.Issuer,
+		Subject:   c.Subject,
+		Audience:  c.Audience,
+		IssuedAt:  timeOrZero(c.IssuedAt),
+		NotBefore: timeOrZero(c.NotBefore),
+		ExpiresAt: time.Unix(c.ExpiresAt, 0),
+		Custom:    c.Custom,
+	}, nil
+}
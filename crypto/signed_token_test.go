@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedToken(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error creating ECDSA key", err)
+	}
+	ecSigner, _ := NewECDSASigner(priv, ECDSAEncodingFixed)
+	hmacSigner, err := NewHMACSigner([]byte(GenerateToken(MinHMACKeySize)))
+	if err != nil {
+		t.Fatal("Error creating HMAC signer", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	for _, s := range []Signer{ecSigner, hmacSigner} {
+		claims := &Claims{
+			Issuer:    "issuer",
+			Subject:   "subject",
+			Audience:  []string{"a", "b"},
+			IssuedAt:  now,
+			ExpiresAt: now.Add(time.Hour),
+			Custom:    map[string]interface{}{"role": "admin", "level": 3},
+		}
+		token, err := Issue(s, claims)
+		if err != nil {
+			t.Fatalf("%s: Issue() error %v", s.Algorithm(), err)
+		}
+		if strings.Count(token, ".") != 2 || strings.ContainsAny(token, "+/=") {
+			t.Errorf("%s: token %q not URL-safe", s.Algorithm(), token)
+		}
+
+		opts := &VerifyOptions{
+			Audience: "b",
+			Issuer:   "issuer",
+			Now:      func() time.Time { return now.Add(30 * time.Minute) },
+		}
+		got, err := Verify(s.Verifier(), token, opts)
+		if err != nil {
+			t.Fatalf("%s: Verify() error %v", s.Algorithm(), err)
+		}
+		if got.Subject != "subject" || len(got.ID) != TokenIDLength ||
+			!got.ExpiresAt.Equal(claims.ExpiresAt) || got.Custom["role"] != "admin" ||
+			got.Custom["level"] != 3.0 {
+			t.Errorf("%s: Verify() claims %+v", s.Algorithm(), got)
+		}
+
+		check := func(name string, token string, opts VerifyOptions, expected error) {
+			t.Helper()
+			if _, err := Verify(s.Verifier(), token, &opts); err != expected {
+				t.Errorf("%s: %s: Verify() error %v != %v", s.Algorithm(), name, err, expected)
+			}
+		}
+		atTime := func(tm time.Time) func() time.Time {
+			return func() time.Time { return tm }
+		}
+
+		o := *opts
+		o.Now = atTime(now.Add(time.Hour + 30*time.Second))
+		check("within skew", token, o, nil)
+		o.Now = atTime(now.Add(time.Hour + 2*time.Minute))
+		check("expired", token, o, ErrTokenExpired)
+		o.ClockSkew = 5 * time.Minute
+		check("larger skew", token, o, nil)
+		o.Now = atTime(now.Add(-2 * time.Minute))
+		o.ClockSkew = 0
+		check("issued in future", token, o, ErrTokenNotYetValid)
+
+		o = *opts
+		o.Audience = "c"
+		check("wrong audience", token, o, ErrWrongAudience)
+		o.Audience = ""
+		check("no audience", token, o, ErrWrongAudience)
+		o = *opts
+		o.Issuer = "other"
+		check("wrong issuer", token, o, ErrWrongIssuer)
+
+		parts := strings.Split(token, ".")
+		tampered, _ := encodeTokenPart(&tokenClaims{Subject: "admin", ExpiresAt: now.Add(time.Hour).Unix()})
+		check("tampered claims", parts[0]+"."+tampered+"."+parts[2], *opts, ErrInvalidSignature)
+		check("truncated", parts[0]+"."+parts[1], *opts, ErrMalformedToken)
+		check("bad encoding", token+"!", *opts, ErrMalformedToken)
+	}
+
+	// Tokens without an audience are only accepted by verifiers without one.
+	token, _ := Issue(hmacSigner, &Claims{ExpiresAt: time.Now().Add(time.Hour)})
+	if _, err := Verify(hmacSigner.Verifier(), token, &VerifyOptions{Audience: "a"}); err != ErrWrongAudience {
+		t.Errorf("Verify(token has no audience) error %v != ErrWrongAudience", err)
+	}
+	if _, err := Verify(hmacSigner.Verifier(), token, nil); err != nil {
+		t.Errorf("Verify(no audience) error %v", err)
+	}
+
+	// Tokens signed with a different algorithm are rejected.
+	if _, err := Verify(ecSigner.Verifier(), token, nil); err != ErrInvalidSignature {
+		t.Errorf("Verify(wrong algorithm) error %v", err)
+	}
+	if _, err := Issue(hmacSigner, &Claims{}); err != ErrNoExpiry {
+		t.Errorf("Issue(no expiry) error %v", err)
+	}
+	if _, err := NewHMACSigner([]byte("short")); err != ErrUnsupportedKey {
+		t.Errorf("NewHMACSigner(short key) error %v", err)
+	}
+}
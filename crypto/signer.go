@@ -0,0 +1,337 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+
+	// Register hash functions used by signers.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	// Minimum RSA key size, in bits, accepted by NewRSAPSSSigner and
+	// NewRSAPSSVerifier.
+	MinRSAKeyBits = 2048
+)
+
+var (
+	ErrInvalidSignature = errors.New("crypto: invalid signature")
+	ErrUnsupportedKey   = errors.New("crypto: unsupported key")
+)
+
+// Signer signs messages. The message is hashed internally, using a hash
+// algorithm determined by the key.
+type Signer interface {
+	// Algorithm returns a name identifying the signature algorithm, hash, and
+	// encoding. For example, "ES256".
+	Algorithm() string
+
+	Sign(msg []byte) ([]byte, error)
+
+	// Verifier returns a Verifier for the signer's public key.
+	Verifier() Verifier
+}
+
+// Verifier verifies signatures created by a Signer.
+type Verifier interface {
+	// Algorithm returns the same name as the corresponding Signer.
+	Algorithm() string
+
+	// Verify returns nil if sig is a valid signature of msg, and
+	// ErrInvalidSignature otherwise.
+	Verify(msg, sig []byte) error
+}
+
+// ECDSAEncoding specifies how ECDSA signatures are encoded.
+type ECDSAEncoding int
+
+const (
+	// ASN.1 DER encoding, as used by SignEC and x509.
+	ECDSAEncodingASN1 ECDSAEncoding = iota
+	// Fixed-width big-endian r||s, as used by JWS.
+	ECDSAEncodingFixed
+)
+
+func hashMsg(h crypto.Hash, msg []byte) []byte {
+	hasher := h.New()
+	hasher.Write(msg)
+	return hasher.Sum(nil)
+}
+
+// ecdsaHash returns the hash algorithm matching the strength of curve.
+func ecdsaHash(curve elliptic.Curve) (crypto.Hash, error) {
+	switch curve.Params().BitSize {
+	case 224:
+		return crypto.SHA224, nil
+	case 256:
+		return crypto.SHA256, nil
+	case 384:
+		return crypto.SHA384, nil
+	case 521:
+		return crypto.SHA512, nil
+	}
+	return 0, ErrUnsupportedKey
+}
+
+type ecdsaVerifier struct {
+	pub  *ecdsa.PublicKey
+	hash crypto.Hash
+	enc  ECDSAEncoding
+}
+
+// NewECDSAVerifier returns a Verifier for ECDSA signatures using pub, with
+// signatures encoded using enc.
+func NewECDSAVerifier(pub *ecdsa.PublicKey, enc ECDSAEncoding) (Verifier, error) {
+	h, err := ecdsaHash(pub.Curve)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsaVerifier{pub: pub, hash: h, enc: enc}, nil
+}
+
+// Algorithm returns the JWS name for the curve and hash, such as "ES512" for
+// P-521 with SHA-512. JWS doesn't define a name for P-224, so "ES224" is used.
+// Names for ECDSAEncodingASN1 have an "-ASN1" suffix.
+func (v *ecdsaVerifier) Algorithm() string {
+	var name string
+	switch v.hash {
+	case crypto.SHA224:
+		name = "ES224"
+	case crypto.SHA256:
+		name = "ES256"
+	case crypto.SHA384:
+		name = "ES384"
+	default:
+		name = "ES512"
+	}
+	if v.enc == ECDSAEncodingASN1 {
+		name += "-ASN1"
+	}
+	return name
+}
+
+// fixedSize returns the size of each of r and s in the fixed-width encoding.
+func (v *ecdsaVerifier) fixedSize() int {
+	return (v.pub.Curve.Params().BitSize + 7) / 8
+}
+
+func (v *ecdsaVerifier) Verify(msg, sig []byte) error {
+	var r, s *big.Int
+	if v.enc == ECDSAEncodingFixed {
+		size := v.fixedSize()
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r = new(big.Int).SetBytes(sig[:size])
+		s = new(big.Int).SetBytes(sig[size:])
+	} else {
+		var err error
+		r, s, err = UnmarshalECSig(sig)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+	}
+	if !ecdsa.Verify(v.pub, hashMsg(v.hash, msg), r, s) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type ecdsaSigner struct {
+	ecdsaVerifier
+	priv *ecdsa.PrivateKey
+}
+
+// NewECDSASigner returns a Signer using priv, with signatures encoded using
+// enc. The hash is chosen based on the curve: SHA-256 for P-256, SHA-384 for
+// P-384, SHA-512 for P-521, and SHA-224 for P-224.
+func NewECDSASigner(priv *ecdsa.PrivateKey, enc ECDSAEncoding) (Signer, error) {
+	h, err := ecdsaHash(priv.Curve)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsaSigner{
+		ecdsaVerifier: ecdsaVerifier{pub: &priv.PublicKey, hash: h, enc: enc},
+		priv:          priv,
+	}, nil
+}
+
+func (s *ecdsaSigner) Sign(msg []byte) ([]byte, error) {
+	digest := hashMsg(s.hash, msg)
+	if s.enc == ECDSAEncodingASN1 {
+		return SignEC(s.priv, digest)
+	}
+
+	r, ss, err := ecdsa.Sign(rand.Reader, s.priv, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := s.fixedSize()
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	ss.FillBytes(sig[size:])
+	return sig, nil
+}
+
+func (s *ecdsaSigner) Verifier() Verifier {
+	return &s.ecdsaVerifier
+}
+
+type ed25519Verifier struct {
+	pub ed25519.PublicKey
+}
+
+// NewEd25519Verifier returns a Verifier for Ed25519 signatures using pub.
+func NewEd25519Verifier(pub ed25519.PublicKey) (Verifier, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, ErrUnsupportedKey
+	}
+	return &ed25519Verifier{pub: pub}, nil
+}
+
+func (*ed25519Verifier) Algorithm() string {
+	return "EdDSA"
+}
+
+func (v *ed25519Verifier) Verify(msg, sig []byte) error {
+	if !ed25519.Verify(v.pub, msg, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type ed25519Signer struct {
+	ed25519Verifier
+	priv ed25519.PrivateKey
+}
+
+// NewEd25519Signer returns a Signer using priv. Ed25519 hashes messages using
+// SHA-512 as part of the signature algorithm.
+func NewEd25519Signer(priv ed25519.PrivateKey) (Signer, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, ErrUnsupportedKey
+	}
+	return &ed25519Signer{
+		ed25519Verifier: ed25519Verifier{pub: priv.Public().(ed25519.PublicKey)},
+		priv:            priv,
+	}, nil
+}
+
+func (s *ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(s.priv, msg), nil
+}
+
+func (s *ed25519Signer) Verifier() Verifier {
+	return &s.ed25519Verifier
+}
+
+// rsaHash returns the hash algorithm for an RSA key of the given size, in
+// bits.
+func rsaHash(bits int) (crypto.Hash, error) {
+	if bits < MinRSAKeyBits {
+		return 0, ErrUnsupportedKey
+	} else if bits < 3072 {
+		return crypto.SHA256, nil
+	} else if bits < 4096 {
+		return crypto.SHA384, nil
+	}
+	return crypto.SHA512, nil
+}
+
+type rsaPSSVerifier struct {
+	pub  *rsa.PublicKey
+	hash crypto.Hash
+}
+
+// NewRSAPSSVerifier returns a Verifier for RSA-PSS signatures using pub.
+func NewRSAPSSVerifier(pub *rsa.PublicKey) (Verifier, error) {
+	h, err := rsaHash(pub.N.BitLen())
+	if err != nil {
+		return nil, err
+	}
+	return &rsaPSSVerifier{pub: pub, hash: h}, nil
+}
+
+func (v *rsaPSSVerifier) Algorithm() string {
+	switch v.hash {
+	case crypto.SHA256:
+		return "PS256"
+	case crypto.SHA384:
+		return "PS384"
+	}
+	return "PS512"
+}
+
+func (v *rsaPSSVerifier) opts() *rsa.PSSOptions {
+	return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: v.hash}
+}
+
+func (v *rsaPSSVerifier) Verify(msg, sig []byte) error {
+	if rsa.VerifyPSS(v.pub, v.hash, hashMsg(v.hash, msg), sig, v.opts()) != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type rsaPSSSigner struct {
+	rsaPSSVerifier
+	priv *rsa.PrivateKey
+}
+
+// NewRSAPSSSigner returns a Signer using priv. The hash is chosen based on the
+// key size: SHA-256 for keys under 3072 bits, SHA-384 for keys under 4096
+// bits, and SHA-512 otherwise. Keys smaller than MinRSAKeyBits are rejected.
+func NewRSAPSSSigner(priv *rsa.PrivateKey) (Signer, error) {
+	h, err := rsaHash(priv.N.BitLen())
+	if err != nil {
+		return nil, err
+	}
+	return &rsaPSSSigner{
+		rsaPSSVerifier: rsaPSSVerifier{pub: &priv.PublicKey, hash: h},
+		priv:           priv,
+	}, nil
+}
+
+func (s *rsaPSSSigner) Sign(msg []byte) ([]byte, error) {
+	return rsa.SignPSS(rand.Reader, s.priv, s.hash, hashMsg(s.hash, msg), s.opts())
+}
+
+func (s *rsaPSSSigner) Verifier() Verifier {
+	return &s.rsaPSSVerifier
+}
+
+// NewSigner returns a Signer for an *ecdsa.PrivateKey, ed25519.PrivateKey, or
+// *rsa.PrivateKey. ECDSA signatures use ECDSAEncodingASN1, and RSA signatures
+// use RSA-PSS.
+func NewSigner(priv crypto.PrivateKey) (Signer, error) {
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		return NewECDSASigner(k, ECDSAEncodingASN1)
+	case ed25519.PrivateKey:
+		return NewEd25519Signer(k)
+	case *rsa.PrivateKey:
+		return NewRSAPSSSigner(k)
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// NewVerifier returns a Verifier for an *ecdsa.PublicKey, ed25519.PublicKey, or
+// *rsa.PublicKey, matching signatures created by NewSigner.
+func NewVerifier(pub crypto.PublicKey) (Verifier, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return NewECDSAVerifier(k, ECDSAEncodingASN1)
+	case ed25519.PublicKey:
+		return NewEd25519Verifier(k)
+	case *rsa.PublicKey:
+		return NewRSAPSSVerifier(k)
+	}
+	return nil, ErrUnsupportedKey
+}
@@ -0,0 +1,161 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+)
+
+func testSigners(t *testing.T) []Signer {
+	t.Helper()
+
+	var signers []Signer
+	add := func(s Signer, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal("Error creating signer", err)
+		}
+		signers = append(signers, s)
+	}
+
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal("Error creating ECDSA key", err)
+		}
+		add(NewECDSASigner(priv, ECDSAEncodingASN1))
+		add(NewECDSASigner(priv, ECDSAEncodingFixed))
+	}
+
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Error creating Ed25519 key", err)
+	}
+	add(NewSigner(edPriv))
+
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Error creating RSA key", err)
+	}
+	add(NewSigner(rsaPriv))
+
+	return signers
+}
+
+func TestSigners(t *testing.T) {
+	msg := []byte("message to be signed")
+	algs := make(map[string]bool)
+	for _, s := range testSigners(t) {
+		alg := s.Algorithm()
+		if algs[alg] {
+			t.Errorf("Duplicate algorithm %s", alg)
+		}
+		algs[alg] = true
+
+		sig, err := s.Sign(msg)
+		if err != nil {
+			t.Errorf("%s: error signing: %v", alg, err)
+			continue
+		}
+		v := s.Verifier()
+		if v.Algorithm() != alg {
+			t.Errorf("%s: verifier algorithm %s", alg, v.Algorithm())
+		}
+		if err := v.Verify(msg, sig); err != nil {
+			t.Errorf("%s: Verify() error %v", alg, err)
+		}
+		if err := v.Verify([]byte("another message"), sig); err != ErrInvalidSignature {
+			t.Errorf("%s: Verify(wrong message) error %v", alg, err)
+		}
+		sig[len(sig)/2] ^= 0x01
+		if err := v.Verify(msg, sig); err != ErrInvalidSignature {
+			t.Errorf("%s: Verify(bad signature) error %v", alg, err)
+		}
+		if err := v.Verify(msg, nil); err != ErrInvalidSignature {
+			t.Errorf("%s: Verify(nil) error %v", alg, err)
+		}
+	}
+}
+
+func TestECDSASignerEncoding(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error creating ECDSA key", err)
+	}
+	msg := []byte("message to be signed")
+	digest := sha256.Sum256(msg)
+
+	s, _ := NewECDSASigner(priv, ECDSAEncodingASN1)
+	sig, err := s.Sign(msg)
+	if err != nil {
+		t.Fatal("Error signing", err)
+	}
+	if !VerifyECSig(&priv.PublicKey, digest[:], sig) {
+		t.Error("ASN.1 signature not compatible with VerifyECSig")
+	}
+
+	s, _ = NewECDSASigner(priv, ECDSAEncodingFixed)
+	sig, err = s.Sign(msg)
+	if err != nil {
+		t.Fatal("Error signing", err)
+	}
+	if len(sig) != 64 {
+		t.Errorf("Fixed signature length %d != 64", len(sig))
+	}
+	if s.Algorithm() != "ES256" {
+		t.Errorf("Algorithm() %s != ES256", s.Algorithm())
+	}
+
+	v, err := NewVerifier(&priv.PublicKey)
+	if err != nil {
+		t.Fatal("Error creating verifier", err)
+	}
+	if err := v.Verify(msg, sig); err != ErrInvalidSignature {
+		t.Errorf("ASN.1 Verify(fixed signature) error %v", err)
+	}
+}
+
+func TestUnsupportedKeys(t *testing.T) {
+	if _, err := NewSigner("not a key"); err != ErrUnsupportedKey {
+		t.Errorf("NewSigner(string) error %v", err)
+	}
+	if _, err := NewVerifier(ed25519.PublicKey{1, 2, 3}); err != ErrUnsupportedKey {
+		t.Errorf("NewVerifier(short key) error %v", err)
+	}
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Error creating RSA key", err)
+	}
+	if _, err := NewRSAPSSSigner(small); err != ErrUnsupportedKey {
+		t.Errorf("NewRSAPSSSigner(1024 bits) error %v", err)
+	}
+}
+
+func TestECDSAAlgorithm(t *testing.T) {
+	for _, tc := range []struct {
+		curve elliptic.Curve
+		alg   string
+	}{
+		{elliptic.P224(), "ES224"},
+		{elliptic.P256(), "ES256"},
+		{elliptic.P384(), "ES384"},
+		{elliptic.P521(), "ES512"},
+	} {
+		priv, err := ecdsa.GenerateKey(tc.curve, rand.Reader)
+		if err != nil {
+			t.Fatal("Error creating ECDSA key", err)
+		}
+		s, _ := NewECDSASigner(priv, ECDSAEncodingFixed)
+		if s.Algorithm() != tc.alg {
+			t.Errorf("%s: Algorithm() %s != %s", tc.curve.Params().Name, s.Algorithm(), tc.alg)
+		}
+		s, _ = NewECDSASigner(priv, ECDSAEncodingASN1)
+		if s.Algorithm() != tc.alg+"-ASN1" {
+			t.Errorf("%s: Algorithm() %s != %s-ASN1", tc.curve.Params().Name, s.Algorithm(), tc.alg)
+		}
+	}
+}